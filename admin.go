@@ -0,0 +1,183 @@
+package quokka
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// there is no leader election or shard allocation yet, every node is standalone:
+// it is its own leader, the only member, and owns the single shard covering all entities.
+// The mode is reported, so that operators do not mistake it for a cluster with one member.
+const clusterModeStandalone = "standalone"
+
+type clusterStatus struct {
+	Mode    string         `json:"mode"`
+	Leader  string         `json:"leader"`
+	Members []memberStatus `json:"members"`
+}
+
+type memberStatus struct {
+	Addr     string `json:"addr"`
+	IsLeader bool   `json:"is_leader"`
+}
+
+type shardMapStatus struct {
+	Mode   string        `json:"mode"`
+	Shards []shardStatus `json:"shards"`
+}
+
+type shardStatus struct {
+	ShardId int      `json:"shard_id"`
+	Owner   string   `json:"owner"`
+	Stores  []string `json:"stores"`
+}
+
+type workerStatus struct {
+	EntityName        string `json:"entity_name"`
+	QueueDepth        int    `json:"queue_depth"`
+	QueueCapacity     int    `json:"queue_capacity"`
+	CacheSize         int64  `json:"cache_size"`
+	BatchSuccess      int64  `json:"batch_success"`
+	BatchFailure      int64  `json:"batch_failure"`
+	ProcessedCommands int64  `json:"processed_commands"`
+	LastBatchSize     int64  `json:"last_batch_size"`
+	HandlerPanics     int64  `json:"handler_panics"`
+	// RateLimited is keyed by the limit, like "tenant:abc"
+	RateLimited map[string]int64 `json:"rate_limited"`
+	// CommandDurations is keyed by command name
+	CommandDurations map[string]commandDurationStatus `json:"command_durations"`
+}
+
+func (cfg *frozenConfig) registerAdminHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/admin/cluster", func(respWriter http.ResponseWriter, req *http.Request) {
+		cfg.writeAdminResponse(respWriter, cfg.clusterStatus())
+	})
+	mux.HandleFunc("/admin/shards", func(respWriter http.ResponseWriter, req *http.Request) {
+		cfg.writeAdminResponse(respWriter, cfg.shardMapStatus())
+	})
+	mux.HandleFunc("/admin/workers", func(respWriter http.ResponseWriter, req *http.Request) {
+		cfg.writeAdminResponse(respWriter, cfg.workerStatuses())
+	})
+	mux.HandleFunc("/admin/purge", func(respWriter http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(respWriter, "purge should be POST", http.StatusMethodNotAllowed)
+			return
+		}
+		worker := cfg.workerOf(req.URL.Query().Get("entity_name"))
+		if worker == nil {
+			http.NotFound(respWriter, req)
+			return
+		}
+		entityId := req.URL.Query().Get("entity_id")
+		err := worker.store.PurgeFromBackend(worker.backend, entityId)
+		if err != nil {
+			writeHttpError(respWriter, err)
+			return
+		}
+		cfg.writeAdminResponse(respWriter, map[string]interface{}{"purged": entityId})
+	})
+	mux.HandleFunc("/admin/dead_letters", func(respWriter http.ResponseWriter, req *http.Request) {
+		limit, err := strconv.Atoi(req.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		letters, err := cfg.listDeadLetters(req.URL.Query().Get("entity_name"), limit)
+		if err != nil {
+			writeHttpError(respWriter, err)
+			return
+		}
+		cfg.writeAdminResponse(respWriter, letters)
+	})
+	mux.HandleFunc("/admin/dead_letters/replay", func(respWriter http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(respWriter, "replay should be POST", http.StatusMethodNotAllowed)
+			return
+		}
+		letterId := req.URL.Query().Get("letter_id")
+		worker, response, err := cfg.replayDeadLetter(letterId)
+		if err == nil {
+			response, err = worker.store.toJson(response)
+		}
+		if err != nil {
+			writeHttpError(respWriter, err)
+			return
+		}
+		cfg.writeAdminResponse(respWriter, map[string]interface{}{"replayed": letterId, "response": json.RawMessage(response)})
+	})
+	mux.HandleFunc("/admin/dead_letters/discard", func(respWriter http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			http.Error(respWriter, "discard should be POST", http.StatusMethodNotAllowed)
+			return
+		}
+		letterId := req.URL.Query().Get("letter_id")
+		err := cfg.DiscardDeadLetter(letterId)
+		if err != nil {
+			writeHttpError(respWriter, err)
+			return
+		}
+		cfg.writeAdminResponse(respWriter, map[string]interface{}{"discarded": letterId})
+	})
+}
+
+func (cfg *frozenConfig) writeAdminResponse(respWriter http.ResponseWriter, status interface{}) {
+	respBytes, err := cfg.jsonApi.Marshal(status)
+	if err != nil {
+		errorLogger.Error("failed to marshal admin response", "error", err)
+		http.Error(respWriter, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respWriter.Header().Set("Content-Type", "application/json")
+	respWriter.Write(respBytes)
+}
+
+func (cfg *frozenConfig) clusterStatus() *clusterStatus {
+	return &clusterStatus{
+		Mode:   clusterModeStandalone,
+		Leader: cfg.httpAddr,
+		Members: []memberStatus{{
+			Addr:     cfg.httpAddr,
+			IsLeader: true,
+		}},
+	}
+}
+
+func (cfg *frozenConfig) shardMapStatus() *shardMapStatus {
+	stores := []string{}
+	for _, worker := range cfg.startedWorkers() {
+		stores = append(stores, worker.store.entityName)
+	}
+	return &shardMapStatus{
+		Mode: clusterModeStandalone,
+		Shards: []shardStatus{{
+			ShardId: 0,
+			Owner:   cfg.httpAddr,
+			Stores:  stores,
+		}},
+	}
+}
+
+func (cfg *frozenConfig) workerStatuses() []workerStatus {
+	statuses := []workerStatus{}
+	for _, worker := range cfg.startedWorkers() {
+		statuses = append(statuses, worker.status())
+	}
+	return statuses
+}
+
+func (worker *worker) status() workerStatus {
+	return workerStatus{
+		EntityName:        worker.store.entityName,
+		QueueDepth:        len(worker.commandQ),
+		QueueCapacity:     cap(worker.commandQ),
+		CacheSize:         atomic.LoadInt64(&worker.stats.cacheSize),
+		BatchSuccess:      atomic.LoadInt64(&worker.stats.batchSuccess),
+		BatchFailure:      atomic.LoadInt64(&worker.stats.batchFailure),
+		ProcessedCommands: atomic.LoadInt64(&worker.stats.processedCommands),
+		LastBatchSize:     atomic.LoadInt64(&worker.stats.lastBatchSize),
+		HandlerPanics:     atomic.LoadInt64(&worker.stats.handlerPanics),
+		CommandDurations:  worker.stats.durations.status(),
+		RateLimited:       worker.rateLimiter.status(),
+	}
+}
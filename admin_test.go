@@ -0,0 +1,36 @@
+package quokka
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+func Test_admin_workers(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{HttpAddr: ":9001"}.Froze()
+	cfg.StoreOf("account").StartWorker(nil)
+	mux := http.NewServeMux()
+	cfg.registerAdminHandlers(mux)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/workers", nil))
+	should.Equal(200, recorder.Code)
+	workers := jsoniter.Get(recorder.Body.Bytes())
+	should.Equal(1, workers.Size())
+	should.Equal("account", workers.Get(0, "entity_name").ToString())
+	should.Equal(10000, workers.Get(0, "queue_capacity").ToInt())
+}
+
+func Test_admin_cluster(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{HttpAddr: ":9001"}.Froze()
+	mux := http.NewServeMux()
+	cfg.registerAdminHandlers(mux)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/cluster", nil))
+	should.Equal(200, recorder.Code)
+	should.Equal(":9001", jsoniter.Get(recorder.Body.Bytes(), "leader").ToString())
+	should.Equal("standalone", jsoniter.Get(recorder.Body.Bytes(), "mode").ToString())
+}
@@ -0,0 +1,109 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrOverloaded is returned when the command queue is full, or the entity has too many commands in flight
+var ErrOverloaded = errors.New("quokka: overloaded")
+
+// QueueCapacity is the capacity of command queue of the worker, default to 10000.
+// HandleAsync blocks when the queue is full, TryHandleAsync returns ErrOverloaded instead.
+//
+// TryHandleAsync and the http api are the entry points of external traffic, only they are admitted by
+// MaxInFlightPerEntity and the rate limits. Handle and HandleAsync are used by tcc, scheduler, process manager,
+// outbox and dead letter replay, they are never rejected by the limits.
+func (store *entityStore) QueueCapacity(capacity int) *entityStore {
+	store.queueCapacity = capacity
+	return store
+}
+
+// MaxInFlightPerEntity limits the commands queued or being handled for one entity,
+// so that one hot entity can not fill the queue shared by all entities.
+// Command over the limit is replied with ErrOverloaded. 0 means no limit.
+// Only TryHandle, TryHandleAsync and the http api are limited, commands of Handle and HandleAsync are not counted.
+func (store *entityStore) MaxInFlightPerEntity(limit int) *entityStore {
+	store.maxInFlight = limit
+	return store
+}
+
+// inFlight counts the commands not replied yet by entity id, it is only used if MaxInFlightPerEntity is set
+type inFlight struct {
+	mutex    *sync.Mutex
+	byEntity map[string]int
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{mutex: &sync.Mutex{}, byEntity: map[string]int{}}
+}
+
+// admit checks the rate limits, then counts the command in flight until it is replied
+func (worker *worker) admit(cmd *command) error {
+	err := worker.checkRateLimits(cmd, time.Now())
+	if err != nil {
+		return err
+	}
+	limit := worker.store.maxInFlight
+	if limit <= 0 {
+		return nil
+	}
+	inFlight := worker.inFlight
+	inFlight.mutex.Lock()
+	defer inFlight.mutex.Unlock()
+	if inFlight.byEntity[cmd.entityId] >= limit {
+		return fmt.Errorf("%w: entity %v has %v commands in flight", ErrOverloaded, cmd.entityId, limit)
+	}
+	inFlight.byEntity[cmd.entityId]++
+	cmd.release = func() {
+		inFlight.mutex.Lock()
+		defer inFlight.mutex.Unlock()
+		inFlight.byEntity[cmd.entityId]--
+		if inFlight.byEntity[cmd.entityId] <= 0 {
+			delete(inFlight.byEntity, cmd.entityId)
+		}
+	}
+	return nil
+}
+
+// TryHandle waits for the response, but not for the queue
+func (worker *worker) TryHandle(entityId string, commandId string, commandName string, request []byte) (
+	[]byte, error) {
+	return worker.TryHandleIfMatch(entityId, commandId, commandName, request, AnyVersion)
+}
+
+// TryHandleAsync never blocks, ErrOverloaded is returned if the command can not be queued now
+func (worker *worker) TryHandleAsync(entityId string, commandId string, commandName string, request []byte) (
+	chan interface{}, error) {
+	return worker.TryHandleAsyncIfMatch(entityId, commandId, commandName, request, AnyVersion)
+}
+
+func (worker *worker) TryHandleAsyncIfMatch(entityId string, commandId string, commandName string, request []byte,
+	expectedVersion int64) (chan interface{}, error) {
+	command := worker.newCommand(entityId, commandId, commandName, request, expectedVersion)
+	err := worker.admit(command)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case worker.commandQ <- command:
+		return command.responsePromise, nil
+	default:
+		if command.release != nil {
+			command.release()
+		}
+		return nil, fmt.Errorf("%w: command queue of %v is full", ErrOverloaded, worker.store.entityName)
+	}
+}
+
+// TryHandleIfMatch waits for the response, but not for the queue
+func (worker *worker) TryHandleIfMatch(entityId string, commandId string, commandName string, request []byte,
+	expectedVersion int64) ([]byte, error) {
+	responseQ, err := worker.TryHandleAsyncIfMatch(entityId, commandId, commandName, request, expectedVersion)
+	if err != nil {
+		return nil, err
+	}
+	return awaitResponse(responseQ)
+}
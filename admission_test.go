@@ -0,0 +1,75 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"github.com/json-iterator/go/require"
+)
+
+func defineBlockingAccount(cfg *frozenConfig, started chan bool, unblock chan bool) *entityStore {
+	return defineAccount(cfg.StoreOf("account")).
+		Command("block", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			started <- true
+			<-unblock
+			return ResponseMessage{}, state, nil
+		})
+}
+
+func Test_try_handle_when_queue_is_full(t *testing.T) {
+	should := require.New(t)
+	started := make(chan bool, 1)
+	unblock := make(chan bool)
+	worker := defineBlockingAccount(Config{}.Froze(), started, unblock).
+		QueueCapacity(1).StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	blocked := worker.HandleAsync(accountId, "block-001", "block", nil)
+	<-started
+	queued, err := worker.TryHandleAsync(NewID().String(), "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.TryHandleAsync(NewID().String(), "create", "create", nil)
+	should.True(errors.Is(err, ErrOverloaded))
+	recorder := httptest.NewRecorder()
+	writeHttpError(recorder, err)
+	should.Equal(http.StatusTooManyRequests, recorder.Code)
+	close(unblock)
+	_, err = awaitResponse(blocked)
+	should.Nil(err)
+	_, err = awaitResponse(queued)
+	should.Nil(err)
+}
+
+func Test_max_in_flight_per_entity(t *testing.T) {
+	should := require.New(t)
+	started := make(chan bool, 1)
+	unblock := make(chan bool)
+	worker := defineBlockingAccount(Config{}.Froze(), started, unblock).
+		MaxInFlightPerEntity(1).StartBackendWorker(NewMemoryBackend())
+	hotId := NewID().String()
+	_, err := worker.Handle(hotId, "create", "create", nil)
+	should.Nil(err)
+	blocked, err := worker.TryHandleAsync(hotId, "block-001", "block", nil)
+	should.Nil(err)
+	<-started
+	_, err = worker.TryHandleAsync(hotId, "xxx-001", "transfer1pc", []byte("100"))
+	should.True(errors.Is(err, ErrOverloaded))
+	// internal traffic is not limited
+	internal := worker.HandleAsync(hotId, "xxx-002", "transfer1pc", []byte("100"))
+	otherQ, err := worker.TryHandleAsync(NewID().String(), "create", "create", nil)
+	should.Nil(err)
+	close(unblock)
+	_, err = awaitResponse(blocked)
+	should.Nil(err)
+	_, err = awaitResponse(otherQ)
+	should.Nil(err)
+	_, err = awaitResponse(internal)
+	should.Nil(err)
+	// the slot is released once replied
+	_, err = worker.TryHandle(hotId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.Equal(0, len(worker.inFlight.byEntity))
+}
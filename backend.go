@@ -0,0 +1,188 @@
+package quokka
+
+import (
+	"database/sql/driver"
+	"errors"
+	"github.com/v2pro/plz/sql"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by Backend when there is no event matching the query
+var ErrNotFound = errors.New("quokka: not found")
+
+// Event is one row of the entity table
+type Event struct {
+	EventId     int64
+	EntityId    string
+	Version     int64
+	CommandId   string
+	CommandName string
+	Request     []byte
+	Response    []byte
+	State       []byte
+	// StateVersion is the schema version of the state, see entityStore.StateVersion
+	StateVersion int
+	// DomainEvents is json array of DomainEvent emitted by the handler, nil if nothing emitted
+	DomainEvents []byte
+	// Tombstone marks the entity as deleted, the state is null
+	Tombstone bool
+	// Codec is the name of codec encoded request, response, state and domain events
+	Codec string
+	// DeltaBase is the snapshot version if the state is json patch against the previous version, see DeltaEncoding
+	DeltaBase int64
+	// Outbox is array of OutboxMessage to deliver after commit, nil if nothing to deliver
+	Outbox      []byte
+	CommittedAt time.Time
+}
+
+// Backend is where the events of one entity table being stored.
+// It must enforce the two unique constraints: (entity_id, version) and (entity_id, command_id)
+type Backend interface {
+	// AppendBatch saves all events or none, unique constraint violation
+	// should be reported as ErrVersionConflict or ErrDuplicateCommand
+	AppendBatch(events []*Event) error
+	// GetLatest returns the event with highest version of the entity
+	GetLatest(entityId string) (*Event, error)
+	GetByCommandId(entityId string, commandId string) (*Event, error)
+	// GetHistory returns all events of the entity, in version order
+	GetHistory(entityId string) ([]*Event, error)
+	// GetHistoryFrom returns the events of the entity with version not less than fromVersion, in version order
+	GetHistoryFrom(entityId string, fromVersion int64) ([]*Event, error)
+	// ScanByOffset returns at most limit events with event id greater than offset, in event id order.
+	// The events are as stored, state is json patch if DeltaBase is not 0, see entityStore.Scan
+	ScanByOffset(offset int64, limit int) ([]*Event, error)
+	// DeleteHistory physically removes the events of the entity up to the version
+	DeleteHistory(entityId string, toVersion int64) error
+}
+
+type sqlBackend struct {
+	store *entityStore
+	conn  sql.Conn
+}
+
+// SqlBackend stores events in the entity table of the database, in the sql dialect configured
+func (store *entityStore) SqlBackend(conn sql.Conn) Backend {
+	return &sqlBackend{store, conn}
+}
+
+func (backend *sqlBackend) AppendBatch(events []*Event) error {
+	store := backend.store
+	rows := make([]driver.Value, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, sql.BatchInsertRow(
+			"entity_id", event.EntityId,
+			"version", event.Version,
+			"command_id", event.CommandId,
+			"command_name", event.CommandName,
+			"request", event.Request,
+			"response", event.Response,
+			"state", event.State,
+			"state_version", event.StateVersion,
+			"events", event.DomainEvents,
+			"tombstone", tombstoneValue(event.Tombstone),
+			"codec", event.Codec,
+			"delta_base", event.DeltaBase,
+			"outbox", event.Outbox))
+	}
+	stmt := backend.conn.TranslateStatement(store.cfg.dialect.BatchInsertSql(store.entityName),
+		sql.BatchInsertColumns(len(rows),
+			"entity_id", "version", "command_id", "command_name", "request", "response", "state", "state_version", "events", "tombstone", "codec", "delta_base", "outbox"))
+	defer stmt.Close()
+	_, err := stmt.Exec(rows...)
+	return store.cfg.dialect.TranslateError(err)
+}
+
+func (backend *sqlBackend) GetLatest(entityId string) (*Event, error) {
+	return backend.queryOne(backend.store.getLatestStateSql, "entity_id", entityId)
+}
+
+func (backend *sqlBackend) GetByCommandId(entityId string, commandId string) (*Event, error) {
+	return backend.queryOne(backend.store.getEventSql, "entity_id", entityId, "command_id", commandId)
+}
+
+func (backend *sqlBackend) GetHistory(entityId string) ([]*Event, error) {
+	return backend.GetHistoryFrom(entityId, 0)
+}
+
+func (backend *sqlBackend) GetHistoryFrom(entityId string, fromVersion int64) ([]*Event, error) {
+	return backend.queryAll(backend.store.getHistorySql, "entity_id", entityId, "version", fromVersion)
+}
+
+func (backend *sqlBackend) ScanByOffset(offset int64, limit int) ([]*Event, error) {
+	return backend.queryAll(backend.store.scanSql, "offset", offset, "limit", limit)
+}
+
+func (backend *sqlBackend) queryAll(translated sql.Translated, kv ...interface{}) ([]*Event, error) {
+	stmt := backend.conn.Statement(translated)
+	defer stmt.Close()
+	rows, err := stmt.Query(kv...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	events := []*Event{}
+	for {
+		err = rows.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, readEvent(rows))
+	}
+}
+
+func (backend *sqlBackend) DeleteHistory(entityId string, toVersion int64) error {
+	stmt := backend.conn.Statement(backend.store.deleteHistorySql)
+	defer stmt.Close()
+	_, err := stmt.Exec("entity_id", entityId, "version", toVersion)
+	return err
+}
+
+// tombstone column is integer, as there is no common boolean type among the dialects
+func tombstoneValue(tombstone bool) int64 {
+	if tombstone {
+		return 1
+	}
+	return 0
+}
+
+func (backend *sqlBackend) queryOne(translated sql.Translated, kv ...interface{}) (*Event, error) {
+	stmt := backend.conn.Statement(translated)
+	defer stmt.Close()
+	rows, err := stmt.Query(kv...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	err = rows.Next()
+	if err == io.EOF {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return readEvent(rows), nil
+}
+
+func readEvent(rows sql.Rows) *Event {
+	return &Event{
+		EventId:      rows.GetInt64(rows.C("event_id")),
+		EntityId:     rows.GetString(rows.C("entity_id")),
+		Version:      rows.GetInt64(rows.C("version")),
+		CommandId:    rows.GetString(rows.C("command_id")),
+		CommandName:  rows.GetString(rows.C("command_name")),
+		Request:      rows.GetByteArray(rows.C("request")),
+		Response:     rows.GetByteArray(rows.C("response")),
+		State:        rows.GetByteArray(rows.C("state")),
+		StateVersion: int(rows.GetInt64(rows.C("state_version"))),
+		DomainEvents: rows.GetByteArray(rows.C("events")),
+		Tombstone:    rows.GetInt64(rows.C("tombstone")) != 0,
+		Codec:        rows.GetString(rows.C("codec")),
+		DeltaBase:    rows.GetInt64(rows.C("delta_base")),
+		Outbox:       rows.GetByteArray(rows.C("outbox")),
+		CommittedAt:  rows.GetTime(rows.C("committed_at")),
+	}
+}
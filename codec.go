@@ -0,0 +1,128 @@
+package quokka
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec encodes request, response and state, the codec name is recorded per row,
+// so that rows written by different codecs can be decoded correctly
+type Codec interface {
+	Marshal(obj interface{}) ([]byte, error)
+	Unmarshal(data []byte, obj interface{}) error
+}
+
+// MsgpackCodec is registered as "msgpack", it should be used with binary columns
+var MsgpackCodec Codec = &msgpackCodec{}
+
+type msgpackCodec struct {
+}
+
+func (codec *msgpackCodec) Marshal(obj interface{}) ([]byte, error) {
+	return msgpack.Marshal(obj)
+}
+
+func (codec *msgpackCodec) Unmarshal(data []byte, obj interface{}) error {
+	return msgpack.Unmarshal(data, obj)
+}
+
+// Codec changes the codec to write new rows of this store, existing rows are still decoded by their own codec.
+// Table created by json codec has json columns, call MigrateToBinary before switching to binary codec.
+func (store *entityStore) Codec(codecName string) *entityStore {
+	codec, err := store.cfg.codecOf(codecName)
+	if err != nil {
+		panic(err)
+	}
+	store.codecName = codecName
+	store.codec = codec
+	return store
+}
+
+// codecOf treats empty name as json, which is the codec of rows written before codec was recorded
+func (cfg *frozenConfig) codecOf(codecName string) (Codec, error) {
+	if codecName == "" {
+		codecName = "json"
+	}
+	codec := cfg.codecs[codecName]
+	if codec == nil {
+		return nil, fmt.Errorf("unknown codec: %v", codecName)
+	}
+	return codec, nil
+}
+
+func (store *entityStore) isStoreCodec(codecName string) bool {
+	return codecName == store.codecName || codecName == "" && store.codecName == "json"
+}
+
+// transcode converts payload of the row codec to the store codec
+func (store *entityStore) transcode(codecName string, data []byte) ([]byte, error) {
+	if len(data) == 0 || store.isStoreCodec(codecName) {
+		return data, nil
+	}
+	decoded, err := store.decodeGeneric(codecName, data)
+	if err != nil {
+		return nil, err
+	}
+	return store.marshalGeneric(decoded)
+}
+
+// decodeGeneric decodes json number as json.Number, so that int64 above 2^53 is not rounded by float64
+func (store *entityStore) decodeGeneric(codecName string, data []byte) (interface{}, error) {
+	if codecName == "" || codecName == "json" {
+		return decodeJsonNumber(data)
+	}
+	codec, err := store.cfg.codecOf(codecName)
+	if err != nil {
+		return nil, err
+	}
+	var decoded interface{}
+	err = codec.Unmarshal(data, &decoded)
+	return decoded, err
+}
+
+// marshalGeneric encodes the result of decodeGeneric by the store codec,
+// json.Number is only understood by json, it is converted to int64 or float64 for other codecs
+func (store *entityStore) marshalGeneric(decoded interface{}) ([]byte, error) {
+	if store.codecName == "json" {
+		return store.codec.Marshal(decoded)
+	}
+	return store.codec.Marshal(fromJsonNumber(decoded))
+}
+
+func fromJsonNumber(decoded interface{}) interface{} {
+	switch value := decoded.(type) {
+	case json.Number:
+		if integer, err := value.Int64(); err == nil {
+			return integer
+		}
+		float, _ := value.Float64()
+		return float
+	case map[string]interface{}:
+		for key, elem := range value {
+			value[key] = fromJsonNumber(elem)
+		}
+	case []interface{}:
+		for i, elem := range value {
+			value[i] = fromJsonNumber(elem)
+		}
+	}
+	return decoded
+}
+
+// toJson converts payload of the store codec to json, for validation and http
+func (store *entityStore) toJson(data []byte) ([]byte, error) {
+	if len(data) == 0 || store.codecName == "json" {
+		return data, nil
+	}
+	decoded, err := store.decodeGeneric(store.codecName, data)
+	if err != nil {
+		return nil, err
+	}
+	return store.cfg.jsonApi.Marshal(decoded)
+}
+
+// fromJson converts json payload to the store codec
+func (store *entityStore) fromJson(data []byte) ([]byte, error) {
+	return store.transcode("json", data)
+}
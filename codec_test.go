@@ -0,0 +1,66 @@
+package quokka
+
+import (
+	"testing"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func Test_msgpack_codec(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{StoreCodec: "msgpack"}.Froze().StoreOf("account"))
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	request, err := msgpack.Marshal(int64(100))
+	should.Nil(err)
+	response, err := worker.Handle(accountId, "xxx-001", "transfer1pc", request)
+	should.Nil(err)
+	var responseMessage ResponseMessage
+	should.Nil(msgpack.Unmarshal(response, &responseMessage))
+	should.Equal(0, responseMessage.Errno)
+	latest, err := backend.GetLatest(accountId)
+	should.Nil(err)
+	should.Equal("msgpack", latest.Codec)
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(100), account.State.(*Account).UsableBalance)
+}
+
+func Test_rows_of_different_codec_can_be_mixed(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	backend := NewMemoryBackend()
+	accountId := NewID().String()
+	jsonWorker := defineAccount(cfg.StoreOf("account")).StartBackendWorker(backend)
+	_, err := jsonWorker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = jsonWorker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	store := defineAccount(cfg.StoreOf("account")).Codec("msgpack")
+	worker := store.StartBackendWorker(backend)
+	request, err := msgpack.Marshal(int64(-30))
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-002", "transfer1pc", request)
+	should.Nil(err)
+	// retry of command committed as json is replied in msgpack
+	response, err := worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	var responseMessage ResponseMessage
+	should.Nil(msgpack.Unmarshal(response, &responseMessage))
+	should.Equal(0, responseMessage.Errno)
+	history, err := store.History(backend, accountId)
+	should.Nil(err)
+	should.Equal(3, len(history))
+	should.Equal("json", history[1].Codec)
+	should.Equal("msgpack", history[2].Codec)
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(70), account.State.(*Account).UsableBalance)
+	state, err := store.toJson(account.StateJson)
+	should.Nil(err)
+	should.Equal(70, jsoniter.Get(state, "UsableBalance").ToInt())
+}
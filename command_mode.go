@@ -0,0 +1,32 @@
+package quokka
+
+import "errors"
+
+// ErrAlreadyExists is returned when MustNotExist command targets an existing entity
+var ErrAlreadyExists = errors.New("quokka: entity already exists")
+
+// ErrUnknownCommand is returned when no handler is registered for the command name
+var ErrUnknownCommand = errors.New("quokka: unknown command")
+
+// CommandMode decides how the command treats missing or existing entity
+type CommandMode int
+
+const (
+	// MustExist command fails with ErrNotFound if the entity does not exist
+	MustExist CommandMode = iota
+	// MustNotExist command creates the entity, fails with ErrAlreadyExists if it exists
+	MustNotExist
+	// CreateIfAbsent command updates the entity, or creates it if absent. Handler gets nil state in that case.
+	CreateIfAbsent
+	// Delete command writes a tombstone if the handler accepts it, the new state returned is ignored.
+	// Deleted entity is not found by Get and other commands, but it can be created again.
+	Delete
+)
+
+// defaultCommandMode keeps the convention before command mode was introduced
+func defaultCommandMode(commandName string) CommandMode {
+	if commandName == "create" {
+		return MustNotExist
+	}
+	return MustExist
+}
@@ -0,0 +1,59 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"github.com/json-iterator/go/require"
+)
+
+func Test_command_modes(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).
+		CommandWithMode("upsert", CreateIfAbsent, nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			if state == nil {
+				return "created", &Account{UsableBalance: 1}, nil
+			}
+			account := state.(*Account)
+			return "updated", &Account{UsableBalance: account.UsableBalance + 1}, nil
+		})
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.True(errors.Is(err, ErrNotFound))
+	response, err := worker.Handle(accountId, "xxx-002", "upsert", nil)
+	should.Nil(err)
+	should.Equal(`"created"`, string(response))
+	response, err = worker.Handle(accountId, "xxx-003", "upsert", nil)
+	should.Nil(err)
+	should.Equal(`"updated"`, string(response))
+	_, err = worker.Handle(accountId, "create", "create", nil)
+	should.True(errors.Is(err, ErrAlreadyExists))
+	// the entity is not in the cache of new worker, the unique constraint tells
+	_, err = store.StartBackendWorker(backend).Handle(accountId, "create-again", "create", nil)
+	should.True(errors.Is(err, ErrAlreadyExists))
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(2), account.State.(*Account).UsableBalance)
+}
+
+func Test_http_status_of_command_errors(t *testing.T) {
+	should := require.New(t)
+	worker := defineAccount(Config{}.Froze().StoreOf("account")).StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	statusOf := func(err error) int {
+		recorder := httptest.NewRecorder()
+		writeHttpError(recorder, err)
+		return recorder.Code
+	}
+	_, err = worker.Handle(accountId, "create-again", "create", nil)
+	should.Equal(http.StatusConflict, statusOf(err))
+	_, err = worker.Handle(accountId, "xxx-001", "unknown", nil)
+	should.True(errors.Is(err, ErrUnknownCommand))
+	should.Equal(http.StatusNotFound, statusOf(err))
+}
@@ -4,17 +4,30 @@ import (
 	"github.com/v2pro/plz"
 	_ "github.com/v2pro/lego/jsoniter_adapter"
 	"github.com/v2pro/plz/codec"
+	"sync"
 )
 
 type Config struct {
 	JsonApi  codec.Codec
 	HttpAddr string
+	Dialect  Dialect
+	// Codecs can be used by name to encode request, response and state. "json" is always JsonApi
+	Codecs map[string]Codec
+	// StoreCodec is the codec name to write new rows, default to "json"
+	StoreCodec string
 }
 
 type frozenConfig struct {
 	configBeforeFrozen Config
 	jsonApi            codec.Codec
 	httpAddr           string
+	dialect            Dialect
+	codecs             map[string]Codec
+	storeCodec         string
+	workersMutex       *sync.Mutex
+	workers            []*worker
+	// deadLetters are of process managers and schedulers, also guarded by workersMutex
+	deadLetters []DeadLetterBackend
 }
 
 func (cfg Config) Froze() *frozenConfig {
@@ -24,7 +37,54 @@ func (cfg Config) Froze() *frozenConfig {
 	if cfg.JsonApi == nil {
 		cfg.JsonApi = plz.Codec("json")
 	}
-	return &frozenConfig{cfg, cfg.JsonApi, cfg.HttpAddr}
+	if cfg.Dialect == nil {
+		cfg.Dialect = DialectMySQL
+	}
+	if cfg.StoreCodec == "" {
+		cfg.StoreCodec = "json"
+	}
+	codecs := map[string]Codec{"msgpack": MsgpackCodec}
+	for codecName, registered := range cfg.Codecs {
+		codecs[codecName] = registered
+	}
+	codecs["json"] = cfg.JsonApi
+	if codecs[cfg.StoreCodec] == nil {
+		panic("unknown store codec: " + cfg.StoreCodec)
+	}
+	return &frozenConfig{
+		configBeforeFrozen: cfg,
+		jsonApi:            cfg.JsonApi,
+		httpAddr:           cfg.HttpAddr,
+		dialect:            cfg.Dialect,
+		codecs:             codecs,
+		storeCodec:         cfg.StoreCodec,
+		workersMutex:       &sync.Mutex{},
+	}
 }
 
 var ConfigDefault = Config{}.Froze()
+
+func (cfg *frozenConfig) registerWorker(worker *worker) {
+	cfg.workersMutex.Lock()
+	defer cfg.workersMutex.Unlock()
+	cfg.workers = append(cfg.workers, worker)
+}
+
+func (cfg *frozenConfig) startedWorkers() []*worker {
+	cfg.workersMutex.Lock()
+	defer cfg.workersMutex.Unlock()
+	return append([]*worker{}, cfg.workers...)
+}
+
+// registerDeadLetters makes the dead letters not recorded by workers visible to the admin api
+func (cfg *frozenConfig) registerDeadLetters(backend DeadLetterBackend) {
+	cfg.workersMutex.Lock()
+	defer cfg.workersMutex.Unlock()
+	cfg.deadLetters = append(cfg.deadLetters, backend)
+}
+
+func (cfg *frozenConfig) registeredDeadLetters() []DeadLetterBackend {
+	cfg.workersMutex.Lock()
+	defer cfg.workersMutex.Unlock()
+	return append([]DeadLetterBackend{}, cfg.deadLetters...)
+}
@@ -0,0 +1,396 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"github.com/v2pro/plz/sql"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DeadLetter is the command failed with error, the attempts are counted by the letter id.
+// ExpectedVersion is the If-Match version of the command, it is checked again when replayed.
+type DeadLetter struct {
+	LetterId        string    `json:"letter_id"`
+	EntityName      string    `json:"entity_name"`
+	EntityId        string    `json:"entity_id"`
+	CommandId       string    `json:"command_id"`
+	CommandName     string    `json:"command_name"`
+	Request         []byte    `json:"request"`
+	ExpectedVersion int64     `json:"expected_version"`
+	Error           string    `json:"error"`
+	Attempts        int       `json:"attempts"`
+	FirstFailedAt   time.Time `json:"first_failed_at"`
+	LastFailedAt    time.Time `json:"last_failed_at"`
+}
+
+// DeadLetterBackend keeps the failed commands until replayed or discarded
+type DeadLetterBackend interface {
+	// Record inserts the letter, or increases the attempts if the letter id has been recorded
+	Record(letter *DeadLetter) error
+	Get(letterId string) (*DeadLetter, error)
+	// List returns at most limit letters of the entity name, all entity names if it is empty
+	List(entityName string, limit int) ([]*DeadLetter, error)
+	Remove(letterId string) error
+}
+
+// deadLetterQueueCapacity bounds the letters waiting to be recorded, letters beyond it are only logged
+const deadLetterQueueCapacity = 1024
+
+// DeadLetter records the commands failed by infrastructure, such as backend failure, panic or time budget exceeded.
+// The error of recording is only logged. Use DeadLetterWhen to choose the errors to record.
+func (store *entityStore) DeadLetter(backend DeadLetterBackend) *entityStore {
+	store.deadLetters = backend
+	return store
+}
+
+// DeadLetterWhen records the commands replied with the error if shouldRecord returns true,
+// instead of the default isInfrastructureFailure
+func (store *entityStore) DeadLetterWhen(shouldRecord func(err error) bool) *entityStore {
+	store.deadLetterWhen = shouldRecord
+	return store
+}
+
+// isInfrastructureFailure tells if the command failed not because of itself, business rejection is not recorded
+func isInfrastructureFailure(err error) bool {
+	var panicErr *PanicError
+	return errors.Is(err, ErrBackend) || errors.Is(err, ErrTimeBudgetExceeded) || errors.As(err, &panicErr)
+}
+
+func deadLetterIdOf(entityName string, entityId string, commandId string) string {
+	return entityName + "/" + entityId + "/" + commandId
+}
+
+func (worker *worker) replyError(cmd *command, err error) {
+	if worker.deadLetterQ != nil && worker.store.shouldRecordDeadLetter(err) {
+		now := time.Now()
+		letter := &DeadLetter{
+			LetterId:        deadLetterIdOf(worker.store.entityName, cmd.entityId, cmd.commandId),
+			EntityName:      worker.store.entityName,
+			EntityId:        cmd.entityId,
+			CommandId:       cmd.commandId,
+			CommandName:     cmd.commandName,
+			Request:         cmd.request,
+			ExpectedVersion: cmd.expectedVersion,
+			Error:           err.Error(),
+			Attempts:        1,
+			FirstFailedAt:   now,
+			LastFailedAt:    now,
+		}
+		// recorded by recordDeadLetters, the worker goroutine does not wait for the backend
+		select {
+		case worker.deadLetterQ <- letter:
+		default:
+			errorLogger.Error("dead letter queue is full",
+				"entity_name", worker.store.entityName,
+				"command_id", cmd.commandId,
+				"error", err)
+		}
+	}
+	cmd.reply(err)
+}
+
+func (store *entityStore) shouldRecordDeadLetter(err error) bool {
+	if store.deadLetterWhen != nil {
+		return store.deadLetterWhen(err)
+	}
+	return isInfrastructureFailure(err)
+}
+
+func (worker *worker) recordDeadLetters() {
+	for letter := range worker.deadLetterQ {
+		err := worker.store.deadLetters.Record(letter)
+		if err != nil {
+			errorLogger.Error("failed to record dead letter",
+				"entity_name", worker.store.entityName,
+				"command_id", letter.CommandId,
+				"error", err)
+		}
+	}
+}
+
+func (worker *worker) delayReplyError(cmd *command, err error) func() {
+	return func() {
+		worker.replyError(cmd, err)
+	}
+}
+
+// deadLetterBackends collects the backends of started workers, for the admin api
+func (cfg *frozenConfig) deadLetterBackends() []DeadLetterBackend {
+	candidates := cfg.registeredDeadLetters()
+	for _, worker := range cfg.startedWorkers() {
+		candidates = append(candidates, worker.store.deadLetters)
+	}
+	backends := []DeadLetterBackend{}
+	for _, backend := range candidates {
+		if backend == nil {
+			continue
+		}
+		found := false
+		for _, collected := range backends {
+			found = found || collected == backend
+		}
+		if !found {
+			backends = append(backends, backend)
+		}
+	}
+	return backends
+}
+
+func (cfg *frozenConfig) listDeadLetters(entityName string, limit int) ([]*DeadLetter, error) {
+	letters := []*DeadLetter{}
+	for _, backend := range cfg.deadLetterBackends() {
+		listed, err := backend.List(entityName, limit-len(letters))
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, listed...)
+		if len(letters) >= limit {
+			break
+		}
+	}
+	return letters, nil
+}
+
+// ReplayDeadLetter handles the command again by the worker of the entity, the letter is removed if succeeded.
+// The response is encoded by the store codec.
+func (cfg *frozenConfig) ReplayDeadLetter(letterId string) ([]byte, error) {
+	_, response, err := cfg.replayDeadLetter(letterId)
+	return response, err
+}
+
+func (cfg *frozenConfig) replayDeadLetter(letterId string) (*worker, []byte, error) {
+	letter, backend, err := cfg.getDeadLetter(letterId)
+	if err != nil {
+		return nil, nil, err
+	}
+	worker := cfg.workerOf(letter.EntityName)
+	if worker == nil {
+		return nil, nil, fmt.Errorf("%w: no worker started for entity %v", ErrNotFound, letter.EntityName)
+	}
+	response, err := worker.HandleIfMatch(letter.EntityId, letter.CommandId, letter.CommandName, letter.Request,
+		letter.ExpectedVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	return worker, response, backend.Remove(letterId)
+}
+
+// DiscardDeadLetter removes the letter without handling it
+func (cfg *frozenConfig) DiscardDeadLetter(letterId string) error {
+	_, backend, err := cfg.getDeadLetter(letterId)
+	if err != nil {
+		return err
+	}
+	return backend.Remove(letterId)
+}
+
+func (cfg *frozenConfig) getDeadLetter(letterId string) (*DeadLetter, DeadLetterBackend, error) {
+	for _, backend := range cfg.deadLetterBackends() {
+		letter, err := backend.Get(letterId)
+		if err == ErrNotFound {
+			continue
+		}
+		return letter, backend, err
+	}
+	return nil, nil, ErrNotFound
+}
+
+type memoryDeadLetterBackend struct {
+	mutex   *sync.Mutex
+	letters map[string]*DeadLetter
+}
+
+// NewMemoryDeadLetterBackend keeps dead letters in memory, for unit testing
+func NewMemoryDeadLetterBackend() DeadLetterBackend {
+	return &memoryDeadLetterBackend{
+		mutex:   &sync.Mutex{},
+		letters: map[string]*DeadLetter{},
+	}
+}
+
+func (backend *memoryDeadLetterBackend) Record(letter *DeadLetter) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	recorded := backend.letters[letter.LetterId]
+	if recorded == nil {
+		copied := *letter
+		backend.letters[letter.LetterId] = &copied
+		return nil
+	}
+	recorded.Attempts++
+	recorded.Error = letter.Error
+	recorded.LastFailedAt = letter.LastFailedAt
+	return nil
+}
+
+func (backend *memoryDeadLetterBackend) Get(letterId string) (*DeadLetter, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	letter := backend.letters[letterId]
+	if letter == nil {
+		return nil, ErrNotFound
+	}
+	copied := *letter
+	return &copied, nil
+}
+
+func (backend *memoryDeadLetterBackend) List(entityName string, limit int) ([]*DeadLetter, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	letters := []*DeadLetter{}
+	for _, letter := range backend.letters {
+		if entityName == "" || letter.EntityName == entityName {
+			copied := *letter
+			letters = append(letters, &copied)
+		}
+	}
+	sort.Slice(letters, func(i, j int) bool {
+		return letters[i].FirstFailedAt.Before(letters[j].FirstFailedAt)
+	})
+	if len(letters) > limit {
+		letters = letters[:limit]
+	}
+	return letters, nil
+}
+
+func (backend *memoryDeadLetterBackend) Remove(letterId string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	delete(backend.letters, letterId)
+	return nil
+}
+
+type sqlDeadLetterBackend struct {
+	cfg        *frozenConfig
+	tableName  string
+	conn       sql.Conn
+	insertSql  sql.Translated
+	updateSql  sql.Translated
+	getSql     sql.Translated
+	listSql    sql.Translated
+	listAllSql sql.Translated
+	removeSql  sql.Translated
+}
+
+// SqlDeadLetterBackend stores dead letters in the table, failed time is stored as unix milliseconds
+func SqlDeadLetterBackend(conn sql.Conn, tableName string) *sqlDeadLetterBackend {
+	return ConfigDefault.SqlDeadLetterBackend(conn, tableName)
+}
+
+func (cfg *frozenConfig) SqlDeadLetterBackend(conn sql.Conn, tableName string) *sqlDeadLetterBackend {
+	return &sqlDeadLetterBackend{
+		cfg:       cfg,
+		tableName: tableName,
+		conn:      conn,
+		insertSql: sql.Translate("INSERT INTO "+tableName+" :INSERT_COLUMNS",
+			"letter_id", "entity_name", "entity_id", "command_id", "command_name", "request", "expected_version",
+			"error", "attempts", "first_failed_at", "last_failed_at"),
+		updateSql: sql.Translate("UPDATE " + tableName +
+			" SET attempts=attempts+1, error=:error, last_failed_at=:last_failed_at WHERE letter_id=:letter_id"),
+		getSql: sql.Translate("SELECT * FROM " + tableName + " WHERE letter_id=:letter_id"),
+		listSql: sql.Translate("SELECT * FROM " + tableName +
+			" WHERE entity_name=:entity_name ORDER BY first_failed_at LIMIT :limit"),
+		listAllSql: sql.Translate("SELECT * FROM " + tableName + " ORDER BY first_failed_at LIMIT :limit"),
+		removeSql:  sql.Translate("DELETE FROM " + tableName + " WHERE letter_id=:letter_id"),
+	}
+}
+
+// CreateTable creates the dead letter table if not exists, request is binary if the store codec is not json
+func (backend *sqlDeadLetterBackend) CreateTable() error {
+	stmt := backend.conn.TranslateStatement(backend.cfg.dialect.CreateDeadLetterTableSql(
+		backend.tableName, backend.cfg.storeCodec != "json"))
+	defer stmt.Close()
+	_, err := stmt.Exec()
+	return err
+}
+
+func (backend *sqlDeadLetterBackend) Record(letter *DeadLetter) error {
+	stmt := backend.conn.Statement(backend.updateSql)
+	defer stmt.Close()
+	result, err := stmt.Exec(
+		"error", letter.Error,
+		"last_failed_at", toUnixMillis(letter.LastFailedAt),
+		"letter_id", letter.LetterId)
+	if err != nil {
+		return err
+	}
+	if updated, _ := result.RowsAffected(); updated > 0 {
+		return nil
+	}
+	insertStmt := backend.conn.Statement(backend.insertSql)
+	defer insertStmt.Close()
+	_, err = insertStmt.Exec(
+		"letter_id", letter.LetterId,
+		"entity_name", letter.EntityName,
+		"entity_id", letter.EntityId,
+		"command_id", letter.CommandId,
+		"command_name", letter.CommandName,
+		"request", letter.Request,
+		"expected_version", letter.ExpectedVersion,
+		"error", letter.Error,
+		"attempts", letter.Attempts,
+		"first_failed_at", toUnixMillis(letter.FirstFailedAt),
+		"last_failed_at", toUnixMillis(letter.LastFailedAt))
+	return err
+}
+
+func (backend *sqlDeadLetterBackend) Get(letterId string) (*DeadLetter, error) {
+	letters, err := backend.query(backend.getSql, "letter_id", letterId)
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, ErrNotFound
+	}
+	return letters[0], nil
+}
+
+func (backend *sqlDeadLetterBackend) List(entityName string, limit int) ([]*DeadLetter, error) {
+	if entityName == "" {
+		return backend.query(backend.listAllSql, "limit", limit)
+	}
+	return backend.query(backend.listSql, "entity_name", entityName, "limit", limit)
+}
+
+func (backend *sqlDeadLetterBackend) Remove(letterId string) error {
+	stmt := backend.conn.Statement(backend.removeSql)
+	defer stmt.Close()
+	_, err := stmt.Exec("letter_id", letterId)
+	return err
+}
+
+func (backend *sqlDeadLetterBackend) query(translated sql.Translated, kv ...interface{}) ([]*DeadLetter, error) {
+	stmt := backend.conn.Statement(translated)
+	defer stmt.Close()
+	rows, err := stmt.Query(kv...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	letters := []*DeadLetter{}
+	for {
+		err = rows.Next()
+		if err == io.EOF {
+			return letters, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		letters = append(letters, &DeadLetter{
+			LetterId:        rows.GetString(rows.C("letter_id")),
+			EntityName:      rows.GetString(rows.C("entity_name")),
+			EntityId:        rows.GetString(rows.C("entity_id")),
+			CommandId:       rows.GetString(rows.C("command_id")),
+			CommandName:     rows.GetString(rows.C("command_name")),
+			Request:         rows.GetByteArray(rows.C("request")),
+			ExpectedVersion: rows.GetInt64(rows.C("expected_version")),
+			Error:           rows.GetString(rows.C("error")),
+			Attempts:        int(rows.GetInt64(rows.C("attempts"))),
+			FirstFailedAt:   fromUnixMillis(rows.GetInt64(rows.C("first_failed_at"))),
+			LastFailedAt:    fromUnixMillis(rows.GetInt64(rows.C("last_failed_at"))),
+		})
+	}
+}
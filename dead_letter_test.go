@@ -0,0 +1,133 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+func Test_dead_letter(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	broken := true
+	deadLetters := NewMemoryDeadLetterBackend()
+	worker, accountId := startAccount(should, defineAccount(cfg.StoreOf("account")).
+		DeadLetter(deadLetters).
+		DeadLetterWhen(func(err error) bool {
+		return err.Error() == "downstream is broken"
+	}).
+		Command("sync", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			if broken {
+				return nil, nil, errors.New("downstream is broken")
+			}
+			return "synced", nil, nil
+		}))
+	_, err := worker.Handle(accountId, "sync-001", "sync", nil)
+	should.NotNil(err)
+	_, err = worker.Handle(accountId, "sync-001", "sync", nil)
+	should.NotNil(err)
+	_, err = worker.Handle(accountId, "sync-002", "sync", nil)
+	should.NotNil(err)
+	waitDeadLetters(should, deadLetters, 2)
+	mux := http.NewServeMux()
+	cfg.registerAdminHandlers(mux)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/admin/dead_letters?entity_name=account", nil))
+	should.Equal(200, recorder.Code)
+	letters := jsoniter.Get(recorder.Body.Bytes())
+	should.Equal(2, letters.Size())
+	should.Equal(2, letters.Get(0, "attempts").ToInt())
+	should.Equal("downstream is broken", letters.Get(0, "error").ToString())
+	broken = false
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST",
+		"/admin/dead_letters/replay?letter_id=account/"+accountId+"/sync-001", nil))
+	should.Equal(200, recorder.Code)
+	should.Equal("synced", jsoniter.Get(recorder.Body.Bytes(), "response").ToString())
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST",
+		"/admin/dead_letters/discard?letter_id=account/"+accountId+"/sync-002", nil))
+	should.Equal(200, recorder.Code)
+	remaining, err := deadLetters.List("", 10)
+	should.Nil(err)
+	should.Equal(0, len(remaining))
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("POST",
+		"/admin/dead_letters/discard?letter_id=account/"+accountId+"/sync-002", nil))
+	should.Equal(404, recorder.Code)
+}
+
+func Test_dead_letter_records_infrastructure_failure_only(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	deadLetters := NewMemoryDeadLetterBackend()
+	worker, accountId := startAccount(should, defineAccount(cfg.StoreOf("account")).
+		DeadLetter(deadLetters).
+		Command("reject", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return nil, nil, errors.New("not allowed")
+		}).
+		Command("crash", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			panic("crashed")
+		}))
+	_, err := worker.Handle(accountId, "reject-001", "reject", nil)
+	should.NotNil(err)
+	_, err = worker.HandleIfMatch(accountId, "crash-001", "crash", nil, 1)
+	should.NotNil(err)
+	letters := waitDeadLetters(should, deadLetters, 1)
+	should.Equal("crash-001", letters[0].CommandId)
+	should.Equal(int64(1), letters[0].ExpectedVersion)
+	// the entity moved on, replaying with the recorded expected version conflicts
+	_, err = worker.Handle(accountId, "transfer-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	_, err = cfg.ReplayDeadLetter(letters[0].LetterId)
+	should.True(errors.Is(err, ErrVersionConflict))
+}
+
+// waitDeadLetters waits the letters recorded asynchronously by the worker
+func waitDeadLetters(should *require.Assertions, backend DeadLetterBackend, count int) []*DeadLetter {
+	for i := 0; i < 100; i++ {
+		letters, err := backend.List("", count+1)
+		should.Nil(err)
+		if len(letters) >= count {
+			should.Equal(count, len(letters))
+			return letters
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	should.Fail("dead letters not recorded")
+	return nil
+}
+
+func Test_sqlite_dead_letter_backend(t *testing.T) {
+	should := require.New(t)
+	conn, cleanup := openSqlite(t)
+	defer cleanup()
+	backend := Config{Dialect: DialectSQLite}.Froze().SqlDeadLetterBackend(conn, "dead_letter")
+	should.Nil(backend.CreateTable())
+	now := time.Now()
+	letter := &DeadLetter{LetterId: "account/a1/c1", EntityName: "account", EntityId: "a1", CommandId: "c1",
+		CommandName: "sync", Request: []byte("100"), ExpectedVersion: 3, Error: "broken", Attempts: 1,
+		FirstFailedAt: now, LastFailedAt: now}
+	should.Nil(backend.Record(letter))
+	letter.Error = "still broken"
+	should.Nil(backend.Record(letter))
+	recorded, err := backend.Get("account/a1/c1")
+	should.Nil(err)
+	should.Equal(2, recorded.Attempts)
+	should.Equal("still broken", recorded.Error)
+	should.Equal("100", string(recorded.Request))
+	should.Equal(int64(3), recorded.ExpectedVersion)
+	letters, err := backend.List("account", 10)
+	should.Nil(err)
+	should.Equal(1, len(letters))
+	should.Nil(backend.Remove("account/a1/c1"))
+	_, err = backend.Get("account/a1/c1")
+	should.Equal(ErrNotFound, err)
+}
@@ -0,0 +1,230 @@
+package quokka
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/evanphx/json-patch"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// DeltaEncoding stores the state as RFC 6902 json patch against the previous version,
+// with full snapshot every snapshotEvery versions. Get and History reconstruct the full state transparently.
+// Only rows written by json codec are delta encoded, as json patch is defined on json document.
+func (store *entityStore) DeltaEncoding(snapshotEvery int) *entityStore {
+	store.snapshotEvery = snapshotEvery
+	return store
+}
+
+// encodeDelta replaces the full state of the event by the patch against the entity,
+// if the entity is the continuation of a snapshot chain of the same codec and state version
+func (store *entityStore) encodeDelta(entity *Entity, event *Event) error {
+	if store.snapshotEvery <= 1 || store.codecName != "json" || event.Tombstone || entity.snapshotVersion == 0 {
+		return nil
+	}
+	if event.Version-entity.snapshotVersion >= int64(store.snapshotEvery) {
+		return nil
+	}
+	patch, err := diffJson(entity.StateJson, event.State)
+	if err != nil {
+		return err
+	}
+	if patch == nil {
+		// the root is not object on both side, take snapshot instead
+		return nil
+	}
+	event.State = patch
+	event.DeltaBase = entity.snapshotVersion
+	return nil
+}
+
+// resolveDelta returns the copy of the event with full state, by applying the patches from the snapshot
+func (store *entityStore) resolveDelta(backend Backend, event *Event) (*Event, error) {
+	if event.DeltaBase == 0 {
+		return event, nil
+	}
+	chain, err := backend.GetHistoryFrom(event.EntityId, event.DeltaBase)
+	if err != nil {
+		return nil, backendFailure(err)
+	}
+	if len(chain) == 0 || chain[0].Version != event.DeltaBase || chain[0].DeltaBase != 0 {
+		return nil, fmt.Errorf("snapshot version %v of entity %v is missing", event.DeltaBase, event.EntityId)
+	}
+	state := chain[0].State
+	for _, patch := range chain[1:] {
+		if patch.Version > event.Version {
+			break
+		}
+		state, err = applyDelta(state, patch)
+		if err != nil {
+			return nil, err
+		}
+	}
+	resolved := *event
+	resolved.State = state
+	resolved.DeltaBase = 0
+	return &resolved, nil
+}
+
+// Scan is ScanByOffset with delta encoded state resolved to full state, views and projections should scan by it
+func (store *entityStore) Scan(backend Backend, offset int64, limit int) ([]*Event, error) {
+	events, err := backend.ScanByOffset(offset, limit)
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]*Event, 0, len(events))
+	// the previous version scanned in the same batch saves reading the chain again
+	previous := map[string]*Event{}
+	for _, event := range events {
+		if event.DeltaBase != 0 {
+			if prev := previous[event.EntityId]; prev != nil && prev.Version == event.Version-1 {
+				state, err := applyDelta(prev.State, event)
+				if err != nil {
+					return nil, err
+				}
+				copied := *event
+				copied.State = state
+				copied.DeltaBase = 0
+				event = &copied
+			} else {
+				event, err = store.resolveDelta(backend, event)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		previous[event.EntityId] = event
+		resolved = append(resolved, event)
+	}
+	return resolved, nil
+}
+
+// resolveHistory replaces the patches in the history by full states
+func resolveHistory(history []*Event) ([]*Event, error) {
+	resolved := make([]*Event, 0, len(history))
+	var state []byte
+	for _, event := range history {
+		if event.DeltaBase == 0 {
+			state = event.State
+			resolved = append(resolved, event)
+			continue
+		}
+		var err error
+		state, err = applyDelta(state, event)
+		if err != nil {
+			return nil, err
+		}
+		copied := *event
+		copied.State = state
+		copied.DeltaBase = 0
+		resolved = append(resolved, &copied)
+	}
+	return resolved, nil
+}
+
+func applyDelta(state []byte, event *Event) ([]byte, error) {
+	if state == nil {
+		return nil, fmt.Errorf("version %v of entity %v is patch without snapshot", event.Version, event.EntityId)
+	}
+	patch, err := jsonpatch.DecodePatch(event.State)
+	if err != nil {
+		return nil, err
+	}
+	state, err = patch.Apply(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to apply patch of version %v: %v", event.Version, err)
+	}
+	return state, nil
+}
+
+type patchOperation struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	// Value is raw json, as null is also a valid value to add or replace
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// diffJson generates json patch turning from into to, nil if the roots are not both object.
+// Objects are compared key by key, other values including array are replaced as a whole.
+func diffJson(from []byte, to []byte) ([]byte, error) {
+	fromObj, err := decodeJsonNumber(from)
+	if err != nil {
+		return nil, err
+	}
+	toObj, err := decodeJsonNumber(to)
+	if err != nil {
+		return nil, err
+	}
+	fromMap, fromIsMap := fromObj.(map[string]interface{})
+	toMap, toIsMap := toObj.(map[string]interface{})
+	if !fromIsMap || !toIsMap {
+		return nil, nil
+	}
+	operations, err := diffObject("", fromMap, toMap, []patchOperation{})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(operations)
+}
+
+func diffObject(path string, from map[string]interface{}, to map[string]interface{},
+	operations []patchOperation) ([]patchOperation, error) {
+	var err error
+	for _, key := range sortedKeys(from) {
+		if _, found := to[key]; !found {
+			operations = append(operations, patchOperation{Op: "remove", Path: path + "/" + escapePointer(key)})
+		}
+	}
+	for _, key := range sortedKeys(to) {
+		keyPath := path + "/" + escapePointer(key)
+		fromValue, found := from[key]
+		op := "replace"
+		if !found {
+			op = "add"
+		} else {
+			fromMap, fromIsMap := fromValue.(map[string]interface{})
+			toMap, toIsMap := to[key].(map[string]interface{})
+			if fromIsMap && toIsMap {
+				operations, err = diffObject(keyPath, fromMap, toMap, operations)
+				if err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if reflect.DeepEqual(fromValue, to[key]) {
+				continue
+			}
+		}
+		value, err := json.Marshal(to[key])
+		if err != nil {
+			return nil, err
+		}
+		operations = append(operations, patchOperation{Op: op, Path: keyPath, Value: value})
+	}
+	return operations, nil
+}
+
+func sortedKeys(obj map[string]interface{}) []string {
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapePointer escapes the key as RFC 6901 json pointer reference token
+func escapePointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// decodeJsonNumber keeps the number as it is, so that big integer survives the diff
+func decodeJsonNumber(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var obj interface{}
+	err := decoder.Decode(&obj)
+	return obj, err
+}
@@ -0,0 +1,98 @@
+package quokka
+
+import (
+	"testing"
+	"strconv"
+	"errors"
+	"github.com/json-iterator/go/require"
+)
+
+func Test_delta_encoding(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).DeltaEncoding(3)
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	for i := 1; i <= 4; i++ {
+		_, err = worker.Handle(accountId, "xxx-00"+strconv.Itoa(i), "transfer1pc", []byte("100"))
+		should.Nil(err)
+	}
+	stored, err := backend.GetHistory(accountId)
+	should.Nil(err)
+	should.Equal(5, len(stored))
+	should.Equal([]int64{0, 1, 1, 0, 4}, []int64{
+		stored[0].DeltaBase, stored[1].DeltaBase, stored[2].DeltaBase, stored[3].DeltaBase, stored[4].DeltaBase})
+	should.Equal(`[{"op":"replace","path":"/UsableBalance","value":200}]`, string(stored[2].State))
+	history, err := store.History(backend, accountId)
+	should.Nil(err)
+	for i, event := range history {
+		state, err := store.decodeState(event.State)
+		should.Nil(err)
+		should.Equal(int64(100*i), state.(*Account).UsableBalance)
+	}
+	// scan from the middle of the chain, and through the chain
+	for _, offset := range []int64{0, 2} {
+		scanned, err := store.Scan(backend, offset, 100)
+		should.Nil(err)
+		for _, event := range scanned {
+			should.Equal(int64(0), event.DeltaBase)
+			state, err := store.decodeState(event.State)
+			should.Nil(err)
+			should.Equal(100*(event.Version-1), state.(*Account).UsableBalance)
+		}
+	}
+	// load from backend by a new store, instead of the worker cache
+	reloaded := defineAccount(Config{}.Froze().StoreOf("account")).DeltaEncoding(3)
+	account, err := reloaded.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(400), account.State.(*Account).UsableBalance)
+	should.Equal(int64(4), account.snapshotVersion)
+	_, err = reloaded.StartBackendWorker(backend).Handle(accountId, "xxx-005", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	latest, err := backend.GetLatest(accountId)
+	should.Nil(err)
+	should.Equal(int64(4), latest.DeltaBase)
+	account, err = store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(500), account.State.(*Account).UsableBalance)
+}
+
+func Test_diff_json(t *testing.T) {
+	should := require.New(t)
+	patch, err := diffJson([]byte(`{"a":1,"b":{"c":[1],"d":"x"},"e/f":null}`), []byte(`{"a":1,"b":{"c":[1,2]},"e/f":9007199254740993}`))
+	should.Nil(err)
+	should.Equal(`[{"op":"remove","path":"/b/d"},{"op":"replace","path":"/b/c","value":[1,2]},`+
+		`{"op":"replace","path":"/e~1f","value":9007199254740993}]`, string(patch))
+	patch, err = diffJson([]byte(`[]`), []byte(`{}`))
+	should.Nil(err)
+	should.Nil(patch)
+}
+
+// historyBackend fails GetHistoryFrom with err, or returns no history if err is nil
+type historyBackend struct {
+	Backend
+	err error
+}
+
+func (backend *historyBackend) GetHistoryFrom(entityId string, fromVersion int64) ([]*Event, error) {
+	return nil, backend.err
+}
+
+func Test_only_backend_failure_in_delta_is_transient(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).DeltaEncoding(3)
+	backend := NewMemoryBackend()
+	accountId := NewID().String()
+	_, err := store.StartBackendWorker(backend).Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = store.StartBackendWorker(backend).Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	_, err = store.loadLatest(&historyBackend{Backend: backend, err: errors.New("connection reset")}, accountId)
+	should.True(IsTransient(err))
+	// missing snapshot can not be fixed by retrying
+	_, err = store.loadLatest(&historyBackend{Backend: backend}, accountId)
+	should.NotNil(err)
+	should.False(IsTransient(err))
+}
@@ -0,0 +1,345 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"strings"
+)
+
+// ErrVersionConflict means some other writer has committed the same version of the entity first
+var ErrVersionConflict = errors.New("quokka: version conflict")
+
+// ErrDuplicateCommand means the command id has already been committed for the entity
+var ErrDuplicateCommand = errors.New("quokka: duplicate command")
+
+// ErrDuplicateColumn means the column to add exists already, the table has been upgraded
+var ErrDuplicateColumn = errors.New("quokka: duplicate column")
+
+// Dialect generates the sql for one kind of database,
+// the table layout and the unique constraints are same for all dialects
+type Dialect interface {
+	Name() string
+	// CreateTableSql uses binary columns for request, response, state, events and outbox if binary is true
+	CreateTableSql(entityName string, binary bool) string
+	// BinaryColumnsSql converts the payload columns of existing json table to binary, see MigrateToBinary.
+	// Rows written before are kept as they are, the codec column still tells how to decode them.
+	BinaryColumnsSql(entityName string) []string
+	// UpgradeTableSql adds the columns missing in the table created by older release, one column per statement
+	UpgradeTableSql(entityName string, binary bool) []string
+	InsertSql(entityName string) string
+	BatchInsertSql(entityName string) string
+	GetLatestStateSql(entityName string) string
+	GetEventSql(entityName string) string
+	// GetHistorySql selects the events of the entity with version not less than :version
+	GetHistorySql(entityName string) string
+	ScanSql(entityName string) string
+	DeleteHistorySql(entityName string) string
+	// CreateScheduleTableSql defines the table of Scheduler, request is binary if binary is true
+	CreateScheduleTableSql(tableName string, binary bool) string
+	// CreateDeadLetterTableSql defines the table of dead letters, request is binary if binary is true
+	CreateDeadLetterTableSql(tableName string, binary bool) string
+	// TranslateError maps unique constraint violation to ErrVersionConflict or ErrDuplicateCommand,
+	// adding existing column to ErrDuplicateColumn, other errors are returned as it is
+	TranslateError(err error) error
+}
+
+var DialectMySQL Dialect = &mysqlDialect{}
+var DialectSQLite Dialect = &sqliteDialect{}
+
+func versionConflict(err error) error {
+	return fmt.Errorf("%w: %v", ErrVersionConflict, err)
+}
+
+func duplicateCommand(err error) error {
+	return fmt.Errorf("%w: %v", ErrDuplicateCommand, err)
+}
+
+// upgradeColumnsSql lists the columns added after the first release of the entity table, in the order added
+func upgradeColumnsSql(addColumn string, payloadType string, flagType string) []string {
+	return []string{
+		addColumn + " state_version INT NOT NULL DEFAULT 0",
+		addColumn + " events " + payloadType + " NULL",
+		addColumn + " tombstone " + flagType + " NOT NULL DEFAULT 0",
+		addColumn + " codec VARCHAR(32) NOT NULL DEFAULT 'json'",
+		addColumn + " delta_base BIGINT NOT NULL DEFAULT 0",
+		addColumn + " outbox " + payloadType + " NULL",
+	}
+}
+
+type mysqlDialect struct {
+}
+
+func (dialect *mysqlDialect) Name() string {
+	return "mysql"
+}
+
+func (dialect *mysqlDialect) CreateTableSql(entityName string, binary bool) string {
+	payloadType := "JSON    "
+	if binary {
+		payloadType = "LONGBLOB"
+	}
+	return "CREATE TABLE IF NOT EXISTS `" + entityName + "` (" + `
+  event_id     BIGINT       NOT NULL       AUTO_INCREMENT,
+  entity_id    CHAR(20)     NOT NULL,
+  version      BIGINT       NOT NULL,
+  command_id   VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      ` + payloadType + `     NULL,
+  response     ` + payloadType + `     NOT NULL,
+  state        ` + payloadType + `     NOT NULL,
+  state_version INT         NOT NULL       DEFAULT 0,
+  events       ` + payloadType + `     NULL,
+  outbox       ` + payloadType + `     NULL,
+  tombstone    TINYINT      NOT NULL       DEFAULT 0,
+  codec        VARCHAR(32)  NOT NULL       DEFAULT 'json',
+  delta_base   BIGINT       NOT NULL       DEFAULT 0,
+  committed_at DATETIME     NOT NULL       DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (event_id),
+  UNIQUE KEY unique_version (entity_id, version),
+  UNIQUE KEY unique_command (entity_id, command_id)
+)`
+}
+
+func (dialect *mysqlDialect) BinaryColumnsSql(entityName string) []string {
+	return []string{"ALTER TABLE `" + entityName + "`" + `
+  MODIFY request  LONGBLOB NULL,
+  MODIFY response LONGBLOB NOT NULL,
+  MODIFY state    LONGBLOB NOT NULL,
+  MODIFY events   LONGBLOB NULL,
+  MODIFY outbox   LONGBLOB NULL`}
+}
+
+func (dialect *mysqlDialect) UpgradeTableSql(entityName string, binary bool) []string {
+	payloadType := "JSON"
+	if binary {
+		payloadType = "LONGBLOB"
+	}
+	return upgradeColumnsSql("ALTER TABLE `"+entityName+"` ADD COLUMN", payloadType, "TINYINT")
+}
+
+func (dialect *mysqlDialect) CreateScheduleTableSql(tableName string, binary bool) string {
+	requestType := "LONGTEXT"
+	if binary {
+		requestType = "LONGBLOB"
+	}
+	return "CREATE TABLE IF NOT EXISTS `" + tableName + "` (" + `
+  schedule_id  VARCHAR(256) NOT NULL,
+  entity_name  VARCHAR(256) NOT NULL,
+  entity_id    VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      ` + requestType + `     NULL,
+  due_at       BIGINT       NOT NULL,
+  PRIMARY KEY (schedule_id),
+  KEY idx_due_at (due_at)
+)`
+}
+
+func (dialect *mysqlDialect) CreateDeadLetterTableSql(tableName string, binary bool) string {
+	requestType := "LONGTEXT"
+	if binary {
+		requestType = "LONGBLOB"
+	}
+	return "CREATE TABLE IF NOT EXISTS `" + tableName + "` (" + `
+  letter_id       VARCHAR(768) NOT NULL,
+  entity_name     VARCHAR(256) NOT NULL,
+  entity_id       VARCHAR(256) NOT NULL,
+  command_id      VARCHAR(256) NOT NULL,
+  command_name    VARCHAR(256) NOT NULL,
+  request         ` + requestType + `     NULL,
+  expected_version BIGINT       NOT NULL DEFAULT -1,
+  error           TEXT         NOT NULL,
+  attempts        INT          NOT NULL,
+  first_failed_at BIGINT       NOT NULL,
+  last_failed_at  BIGINT       NOT NULL,
+  PRIMARY KEY (letter_id),
+  KEY idx_entity_name (entity_name, first_failed_at)
+)`
+}
+
+const (
+	mysqlDuplicateColumn = 1060
+	mysqlDuplicateEntry  = 1062
+)
+
+// TranslateError recognizes "Error 1062: Duplicate entry '...' for key 'unique_version'"
+// and "Error 1060: Duplicate column name '...'"
+func (dialect *mysqlDialect) TranslateError(err error) error {
+	var mysqlErr *mysql.MySQLError
+	if !errors.As(err, &mysqlErr) {
+		return err
+	}
+	switch mysqlErr.Number {
+	case mysqlDuplicateColumn:
+		return fmt.Errorf("%w: %v", ErrDuplicateColumn, err)
+	case mysqlDuplicateEntry:
+		// the key name is quoted at the end, the entry before it might contain anything
+		if strings.HasSuffix(mysqlErr.Message, "unique_version'") {
+			return versionConflict(err)
+		}
+		if strings.HasSuffix(mysqlErr.Message, "unique_command'") {
+			return duplicateCommand(err)
+		}
+	}
+	return err
+}
+
+func (dialect *mysqlDialect) InsertSql(entityName string) string {
+	return "INSERT " + entityName + " :INSERT_COLUMNS"
+}
+
+func (dialect *mysqlDialect) BatchInsertSql(entityName string) string {
+	return "INSERT " + entityName + " :BATCH_INSERT_COLUMNS"
+}
+
+func (dialect *mysqlDialect) GetLatestStateSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id ORDER BY version DESC LIMIT 1"
+}
+
+func (dialect *mysqlDialect) GetEventSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND command_id=:command_id"
+}
+
+func (dialect *mysqlDialect) GetHistorySql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND version>=:version ORDER BY version"
+}
+
+func (dialect *mysqlDialect) DeleteHistorySql(entityName string) string {
+	return "DELETE FROM " + entityName + " WHERE entity_id=:entity_id AND version<=:version"
+}
+
+func (dialect *mysqlDialect) ScanSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE event_id>:offset ORDER BY event_id LIMIT :limit"
+}
+
+// sqliteDialect is meant for local development and tests, where there is no mysql around
+type sqliteDialect struct {
+}
+
+func (dialect *sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+func (dialect *sqliteDialect) CreateTableSql(entityName string, binary bool) string {
+	payloadType := "TEXT"
+	if binary {
+		payloadType = "BLOB"
+	}
+	return `CREATE TABLE IF NOT EXISTS "` + entityName + `" (
+  event_id     INTEGER      NOT NULL       PRIMARY KEY AUTOINCREMENT,
+  entity_id    CHAR(20)     NOT NULL,
+  version      BIGINT       NOT NULL,
+  command_id   VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      ` + payloadType + `         NULL,
+  response     ` + payloadType + `         NOT NULL,
+  state        ` + payloadType + `         NOT NULL,
+  state_version INT         NOT NULL       DEFAULT 0,
+  events       ` + payloadType + `         NULL,
+  outbox       ` + payloadType + `         NULL,
+  tombstone    INTEGER      NOT NULL       DEFAULT 0,
+  codec        VARCHAR(32)  NOT NULL       DEFAULT 'json',
+  delta_base   BIGINT       NOT NULL       DEFAULT 0,
+  committed_at DATETIME     NOT NULL       DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT unique_version UNIQUE (entity_id, version),
+  CONSTRAINT unique_command UNIQUE (entity_id, command_id)
+)`
+}
+
+// BinaryColumnsSql is empty, as sqlite column type does not restrict the value stored
+func (dialect *sqliteDialect) BinaryColumnsSql(entityName string) []string {
+	return nil
+}
+
+func (dialect *sqliteDialect) UpgradeTableSql(entityName string, binary bool) []string {
+	payloadType := "TEXT"
+	if binary {
+		payloadType = "BLOB"
+	}
+	return upgradeColumnsSql(`ALTER TABLE "`+entityName+`" ADD COLUMN`, payloadType, "INTEGER")
+}
+
+func (dialect *sqliteDialect) CreateScheduleTableSql(tableName string, binary bool) string {
+	requestType := "TEXT"
+	if binary {
+		requestType = "BLOB"
+	}
+	return `CREATE TABLE IF NOT EXISTS "` + tableName + `" (
+  schedule_id  VARCHAR(256) NOT NULL       PRIMARY KEY,
+  entity_name  VARCHAR(256) NOT NULL,
+  entity_id    VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      ` + requestType + `         NULL,
+  due_at       BIGINT       NOT NULL
+)`
+}
+
+func (dialect *sqliteDialect) CreateDeadLetterTableSql(tableName string, binary bool) string {
+	requestType := "TEXT"
+	if binary {
+		requestType = "BLOB"
+	}
+	return `CREATE TABLE IF NOT EXISTS "` + tableName + `" (
+  letter_id       VARCHAR(768) NOT NULL       PRIMARY KEY,
+  entity_name     VARCHAR(256) NOT NULL,
+  entity_id       VARCHAR(256) NOT NULL,
+  command_id      VARCHAR(256) NOT NULL,
+  command_name    VARCHAR(256) NOT NULL,
+  request         ` + requestType + `         NULL,
+  expected_version BIGINT       NOT NULL DEFAULT -1,
+  error           TEXT         NOT NULL,
+  attempts        INT          NOT NULL,
+  first_failed_at BIGINT       NOT NULL,
+  last_failed_at  BIGINT       NOT NULL
+)`
+}
+
+// TranslateError recognizes "UNIQUE constraint failed: account.entity_id, account.version"
+// and "duplicate column name: ..."
+func (dialect *sqliteDialect) TranslateError(err error) error {
+	if err == nil {
+		return nil
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "duplicate column name") {
+		return fmt.Errorf("%w: %v", ErrDuplicateColumn, err)
+	}
+	if !strings.Contains(msg, "UNIQUE constraint failed") {
+		return err
+	}
+	if strings.HasSuffix(msg, ".version") {
+		return versionConflict(err)
+	}
+	if strings.HasSuffix(msg, ".command_id") {
+		return duplicateCommand(err)
+	}
+	return err
+}
+
+func (dialect *sqliteDialect) InsertSql(entityName string) string {
+	return "INSERT INTO " + entityName + " :INSERT_COLUMNS"
+}
+
+func (dialect *sqliteDialect) BatchInsertSql(entityName string) string {
+	return "INSERT INTO " + entityName + " :BATCH_INSERT_COLUMNS"
+}
+
+func (dialect *sqliteDialect) GetLatestStateSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id ORDER BY version DESC LIMIT 1"
+}
+
+func (dialect *sqliteDialect) GetEventSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND command_id=:command_id"
+}
+
+func (dialect *sqliteDialect) GetHistorySql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND version>=:version ORDER BY version"
+}
+
+func (dialect *sqliteDialect) DeleteHistorySql(entityName string) string {
+	return "DELETE FROM " + entityName + " WHERE entity_id=:entity_id AND version<=:version"
+}
+
+func (dialect *sqliteDialect) ScanSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE event_id>:offset ORDER BY event_id LIMIT :limit"
+}
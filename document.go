@@ -0,0 +1,72 @@
+package quokka
+
+import (
+	"encoding/json"
+	"github.com/evanphx/json-patch"
+)
+
+// DocumentCommands registers built-in commands, so that schema free document collection needs no custom handler:
+//
+//   - create: the request is the initial document, registered only if there is no create handler yet
+//   - replace: the request is the new document, creates the document if absent
+//   - merge_patch: the request is RFC 7386 merge patch
+//   - json_patch: the request is RFC 6902 json patch, failed "test" operation rejects the command
+//
+// The requests are json, so the store codec should be json too.
+func (store *entityStore) DocumentCommands() *entityStore {
+	if store.commandHandlers["create"] == nil {
+		store.Command("create", newRawRequest, store.replaceDocument)
+	}
+	store.CommandWithMode("replace", CreateIfAbsent, newRawRequest, store.replaceDocument)
+	store.Command("merge_patch", newRawRequest, store.mergePatchDocument)
+	store.Command("json_patch", newRawRequest, store.jsonPatchDocument)
+	return store
+}
+
+func newRawRequest() interface{} {
+	return &json.RawMessage{}
+}
+
+func (store *entityStore) replaceDocument(request interface{}, state interface{}) (interface{}, interface{}, error) {
+	newState, err := store.decodeStateWith("json", *request.(*json.RawMessage))
+	if err != nil {
+		return nil, nil, err
+	}
+	return struct{}{}, newState, nil
+}
+
+func (store *entityStore) mergePatchDocument(request interface{}, state interface{}) (interface{}, interface{}, error) {
+	stateJson, err := store.cfg.jsonApi.Marshal(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	newStateJson, err := jsonpatch.MergePatch(stateJson, *request.(*json.RawMessage))
+	if err != nil {
+		return nil, nil, err
+	}
+	newState, err := store.decodeStateWith("json", newStateJson)
+	if err != nil {
+		return nil, nil, err
+	}
+	return struct{}{}, newState, nil
+}
+
+func (store *entityStore) jsonPatchDocument(request interface{}, state interface{}) (interface{}, interface{}, error) {
+	patch, err := jsonpatch.DecodePatch(*request.(*json.RawMessage))
+	if err != nil {
+		return nil, nil, err
+	}
+	stateJson, err := store.cfg.jsonApi.Marshal(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	newStateJson, err := patch.Apply(stateJson)
+	if err != nil {
+		return nil, nil, err
+	}
+	newState, err := store.decodeStateWith("json", newStateJson)
+	if err != nil {
+		return nil, nil, err
+	}
+	return struct{}{}, newState, nil
+}
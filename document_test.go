@@ -0,0 +1,70 @@
+package quokka
+
+import (
+	"testing"
+	"encoding/json"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+func Test_document_commands(t *testing.T) {
+	should := require.New(t)
+	store := Config{}.Froze().StoreOf("document").DocumentCommands()
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	docId := NewID().String()
+	_, err := worker.Handle(docId, "create", "create", []byte(`{"title":"hello","tags":["a"]}`))
+	should.Nil(err)
+	_, err = worker.Handle(docId, "xxx-001", "merge_patch", []byte(`{"title":null,"author":"alice"}`))
+	should.Nil(err)
+	doc, err := store.GetFromBackend(backend, docId)
+	should.Nil(err)
+	should.Equal(map[string]interface{}{
+		"tags": []interface{}{"a"}, "author": "alice",
+	}, doc.State)
+	_, err = worker.Handle(docId, "xxx-002", "json_patch", []byte(`[
+		{"op":"test","path":"/author","value":"bob"},
+		{"op":"add","path":"/tags/-","value":"b"}]`))
+	should.NotNil(err)
+	_, err = worker.Handle(docId, "xxx-003", "json_patch", []byte(`[
+		{"op":"test","path":"/author","value":"alice"},
+		{"op":"add","path":"/tags/-","value":"b"}]`))
+	should.Nil(err)
+	_, err = worker.Handle(docId, "xxx-004", "replace", []byte(`{"title":"replaced"}`))
+	should.Nil(err)
+	doc, err = store.GetFromBackend(backend, docId)
+	should.Nil(err)
+	should.Equal(int64(4), doc.Version)
+	should.Equal(map[string]interface{}{"title": "replaced"}, doc.State)
+	history, err := store.History(backend, docId)
+	should.Nil(err)
+	should.Equal("b", jsoniter.Get(history[2].State, "tags", 1).ToString())
+}
+
+func Test_document_keeps_big_integer(t *testing.T) {
+	should := require.New(t)
+	store := Config{}.Froze().StoreOf("document").DocumentCommands()
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	docId := NewID().String()
+	_, err := worker.Handle(docId, "create", "create", []byte(`{"id":9007199254740993}`))
+	should.Nil(err)
+	_, err = worker.Handle(docId, "xxx-001", "merge_patch", []byte(`{"amount":9007199254740995}`))
+	should.Nil(err)
+	_, err = worker.Handle(docId, "xxx-002", "json_patch", []byte(`[
+		{"op":"test","path":"/id","value":9007199254740993},
+		{"op":"add","path":"/counter","value":9007199254740997}]`))
+	should.Nil(err)
+	doc, err := store.GetFromBackend(backend, docId)
+	should.Nil(err)
+	should.Equal(map[string]interface{}{
+		"id":      json.Number("9007199254740993"),
+		"amount":  json.Number("9007199254740995"),
+		"counter": json.Number("9007199254740997"),
+	}, doc.State)
+	_, err = worker.Handle(docId, "xxx-003", "replace", []byte(`{"id":9007199254740993}`))
+	should.Nil(err)
+	history, err := store.History(backend, docId)
+	should.Nil(err)
+	should.Equal(`{"id":9007199254740993}`, string(history[3].State))
+}
@@ -0,0 +1,59 @@
+package quokka
+
+// DomainEvent tells what happened, so that downstream does not need to diff the states
+type DomainEvent struct {
+	Name    string      `json:"name"`
+	Payload interface{} `json:"payload"`
+}
+
+// Result can be returned by handler as the response, to emit more than the response itself.
+// Only Response will be replied to the caller.
+type Result struct {
+	Response interface{}
+	Events   []DomainEvent
+	// Outbox is delivered by OutboxDispatcher after commit, as the handler itself should not have side effect
+	Outbox []OutboxMessage
+	// Schedule and Unschedule are delivered to Scheduler by the outbox, after the outbox messages
+	Schedule   []ScheduledCommand
+	Unschedule []string
+}
+
+// outboxMessages appends the schedules to the outbox, as they are also delivered after commit
+func (result *Result) outboxMessages() []OutboxMessage {
+	messages := append([]OutboxMessage{}, result.Outbox...)
+	for i := range result.Schedule {
+		messages = append(messages, OutboxMessage{SchedulerSink, scheduleMessage{Schedule: &result.Schedule[i]}})
+	}
+	for _, scheduleId := range result.Unschedule {
+		messages = append(messages, OutboxMessage{SchedulerSink, scheduleMessage{Unschedule: scheduleId}})
+	}
+	return messages
+}
+
+// DomainEventsOf decodes the domain events persisted with the event by its own codec,
+// payload is decoded as generic map
+func (store *entityStore) DomainEventsOf(event *Event) ([]DomainEvent, error) {
+	if len(event.DomainEvents) == 0 {
+		return nil, nil
+	}
+	codec, err := store.cfg.codecOf(event.Codec)
+	if err != nil {
+		return nil, err
+	}
+	var domainEvents []DomainEvent
+	err = codec.Unmarshal(event.DomainEvents, &domainEvents)
+	if err != nil {
+		return nil, err
+	}
+	return domainEvents, nil
+}
+
+// History returns all events of the entity in version order, domain events included.
+// Delta encoded state is reconstructed as full state.
+func (store *entityStore) History(backend Backend, entityId string) ([]*Event, error) {
+	history, err := backend.GetHistory(entityId)
+	if err != nil {
+		return nil, err
+	}
+	return resolveHistory(history)
+}
@@ -0,0 +1,50 @@
+package quokka
+
+import (
+	"testing"
+	"github.com/json-iterator/go/require"
+)
+
+type MoneyTransferred struct {
+	Amount int64
+}
+
+func Test_domain_events(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).
+		Command("deposit",
+		func() interface{} {
+			var val int64
+			return &val
+		},
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			amount := *(request.(*int64))
+			account := state.(*Account)
+			return &Result{
+				Response: ResponseMessage{Errno: 0},
+				Events:   []DomainEvent{{"MoneyTransferred", MoneyTransferred{amount}}},
+			}, &Account{UsableBalance: account.UsableBalance + amount}, nil
+		})
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	response, err := worker.Handle(accountId, "xxx-001", "deposit", []byte("100"))
+	should.Nil(err)
+	should.Equal(`{"Errno":0,"Errmsg":""}`, string(response))
+	history, err := store.History(backend, accountId)
+	should.Nil(err)
+	should.Equal(2, len(history))
+	domainEvents, err := store.DomainEventsOf(history[0])
+	should.Nil(err)
+	should.Equal(0, len(domainEvents))
+	domainEvents, err = store.DomainEventsOf(history[1])
+	should.Nil(err)
+	should.Equal(1, len(domainEvents))
+	should.Equal("MoneyTransferred", domainEvents[0].Name)
+	should.Equal(float64(100), domainEvents[0].Payload.(map[string]interface{})["Amount"])
+	scanned, err := backend.ScanByOffset(0, 10)
+	should.Nil(err)
+	should.Equal(history[1].DomainEvents, scanned[1].DomainEvents)
+}
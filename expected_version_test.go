@@ -0,0 +1,93 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"github.com/json-iterator/go/require"
+)
+
+func Test_expected_version(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	store := defineAccount(Config{}.Froze().StoreOf("account"))
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.HandleIfMatch(accountId, "create", "create", nil, 0)
+	should.Nil(err)
+	_, err = worker.HandleIfMatch(accountId, "xxx-001", "transfer1pc", []byte("100"), 1)
+	should.Nil(err)
+	_, err = worker.HandleIfMatch(accountId, "xxx-002", "transfer1pc", []byte("100"), 1)
+	should.True(errors.Is(err, ErrVersionConflict))
+	// retry of committed command is not a conflict
+	_, err = worker.HandleIfMatch(accountId, "xxx-001", "transfer1pc", []byte("100"), 1)
+	should.Nil(err)
+	// version written by other worker should not be a conflict
+	otherWorker := store.StartBackendWorker(backend)
+	_, err = otherWorker.Handle(accountId, "xxx-003", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	_, err = worker.HandleIfMatch(accountId, "xxx-004", "transfer1pc", []byte("100"), 3)
+	should.Nil(err)
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(4), account.Version)
+	should.Equal(int64(300), account.State.(*Account).UsableBalance)
+}
+
+func Test_http_if_match(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	worker := defineAccount(cfg.StoreOf("account")).StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	mux := http.NewServeMux()
+	cfg.registerEntityHandlers(mux)
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, httptest.NewRequest("GET", "/entity/account/"+accountId, nil))
+	should.Equal(200, recorder.Code)
+	etag := recorder.Header().Get("ETag")
+	should.Equal(`"1"`, etag)
+	post := func(commandId string) int {
+		req := httptest.NewRequest("POST", "/entity/account/"+accountId+"/transfer1pc", strings.NewReader("100"))
+		req.Header.Set("X-Command-Id", commandId)
+		req.Header.Set("If-Match", etag)
+		recorder := httptest.NewRecorder()
+		mux.ServeHTTP(recorder, req)
+		return recorder.Code
+	}
+	should.Equal(200, post("xxx-001"))
+	should.Equal(http.StatusPreconditionFailed, post("xxx-002"))
+	// conflict without If-Match is not a failed precondition
+	recorder = httptest.NewRecorder()
+	writeHttpError(recorder, versionConflict(errors.New("concurrent update")))
+	should.Equal(http.StatusConflict, recorder.Code)
+}
+
+func Test_stale_expected_version_in_batch_fails_fast(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	store := defineAccount(Config{}.Froze().StoreOf("account"))
+	worker := &worker{
+		store:       store,
+		backend:     backend,
+		entityCache: map[string]*Entity{},
+		inFlight:    newInFlight(),
+		rateLimiter: newRateLimiter(),
+		stats:       workerStats{durations: newCommandDurations()},
+	}
+	accountId := NewID().String()
+	should.Nil(worker.batchProcess([]*command{worker.newCommand(accountId, "create", "create", nil, 0)}))
+	first := worker.newCommand(accountId, "xxx-001", "transfer1pc", []byte("100"), 1)
+	second := worker.newCommand(accountId, "xxx-002", "transfer1pc", []byte("100"), 1)
+	should.Nil(worker.batchProcess([]*command{first, second}))
+	_, err := awaitResponse(first.responsePromise)
+	should.Nil(err)
+	_, err = awaitResponse(second.responsePromise)
+	should.True(errors.Is(err, ErrVersionConflict))
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(2), account.Version)
+}
@@ -1,6 +1,14 @@
 package quokka
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
 
 func StartHttpServer() {
 	ConfigDefault.StartHttpServer()
@@ -8,6 +16,8 @@ func StartHttpServer() {
 
 func (cfg *frozenConfig) StartHttpServer() {
 	mux := http.NewServeMux()
+	cfg.registerAdminHandlers(mux)
+	cfg.registerEntityHandlers(mux)
 	http.ListenAndServe(cfg.httpAddr, mux)
 }
 
@@ -15,4 +25,147 @@ type ClientConfig struct {
 	HttpAddr string
 }
 
+// registerEntityHandlers serves the entity stores with started worker
+//
+//   - GET /entity/{entity_name}/{entity_id} returns the state, with version as ETag
+//   - POST /entity/{entity_name}/{entity_id}/{command_name} handles the command,
+//     X-Command-Id header is the command id, If-Match header is the expected version
+func (cfg *frozenConfig) registerEntityHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/entity/", func(respWriter http.ResponseWriter, req *http.Request) {
+		path := strings.Split(strings.TrimPrefix(req.URL.Path, "/entity/"), "/")
+		worker := cfg.workerOf(path[0])
+		if worker == nil {
+			http.NotFound(respWriter, req)
+			return
+		}
+		switch {
+		case len(path) == 2 && req.Method == "GET":
+			worker.serveGet(respWriter, path[1])
+		case len(path) == 3 && req.Method == "POST":
+			worker.serveCommand(respWriter, req, path[1], path[2])
+		default:
+			http.Error(respWriter, "unsupported: "+req.Method+" "+req.URL.Path, http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (cfg *frozenConfig) workerOf(entityName string) *worker {
+	for _, worker := range cfg.startedWorkers() {
+		if worker.store.entityName == entityName {
+			return worker
+		}
+	}
+	return nil
+}
+
+func (worker *worker) serveGet(respWriter http.ResponseWriter, entityId string) {
+	entity, err := worker.store.GetFromBackend(worker.backend, entityId)
+	if err != nil {
+		writeHttpError(respWriter, err)
+		return
+	}
+	state, err := worker.store.toJson(entity.StateJson)
+	if err != nil {
+		writeHttpError(respWriter, err)
+		return
+	}
+	respWriter.Header().Set("ETag", formatETag(entity.Version))
+	respWriter.Header().Set("Content-Type", "application/json")
+	respWriter.Write(state)
+}
+
+func (worker *worker) serveCommand(respWriter http.ResponseWriter, req *http.Request, entityId string, commandName string) {
+	request, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		writeHttpError(respWriter, err)
+		return
+	}
+	// http speaks json, the handler speaks the store codec
+	request, err = worker.store.fromJson(request)
+	if err != nil {
+		http.Error(respWriter, err.Error(), http.StatusBadRequest)
+		return
+	}
+	commandId := req.Header.Get("X-Command-Id")
+	if commandId == "" {
+		commandId = NewID().String()
+	}
+	expectedVersion := AnyVersion
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		expectedVersion, err = parseETag(ifMatch)
+		if err != nil {
+			http.Error(respWriter, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	response, err := worker.TryHandleIfMatch(entityId, commandId, commandName, request, expectedVersion)
+	if err == nil {
+		response, err = worker.store.toJson(response)
+	}
+	if err != nil && expectedVersion != AnyVersion && errors.Is(err, ErrVersionConflict) {
+		// only the precondition of the client fails with 412, concurrent writers conflict with 409
+		http.Error(respWriter, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	if err != nil {
+		writeHttpError(respWriter, err)
+		return
+	}
+	respWriter.Header().Set("Content-Type", "application/json")
+	respWriter.Write(response)
+}
 
+func writeHttpError(respWriter http.ResponseWriter, err error) {
+	var validationError *ValidationError
+	var rateLimitError *RateLimitError
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(respWriter, err.Error(), http.StatusNotFound)
+	case errors.Is(err, ErrVersionConflict):
+		http.Error(respWriter, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrAlreadyExists):
+		http.Error(respWriter, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrUnknownCommand):
+		http.Error(respWriter, err.Error(), http.StatusNotFound)
+	case errors.As(err, &validationError):
+		writeValidationError(respWriter, validationError)
+	case errors.As(err, &rateLimitError):
+		retryAfter := int64(math.Ceil(rateLimitError.RetryAfter.Seconds()))
+		respWriter.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+		http.Error(respWriter, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrOverloaded):
+		http.Error(respWriter, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(respWriter, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// writeValidationError responds the violations, so that the client can point out the invalid fields
+func writeValidationError(respWriter http.ResponseWriter, validationError *ValidationError) {
+	body, err := json.Marshal(map[string]interface{}{
+		"error":      validationError.Error(),
+		"target":     validationError.Target,
+		"violations": validationError.Violations,
+	})
+	if err != nil {
+		http.Error(respWriter, validationError.Error(), http.StatusBadRequest)
+		return
+	}
+	respWriter.Header().Set("Content-Type", "application/json")
+	respWriter.WriteHeader(http.StatusBadRequest)
+	respWriter.Write(body)
+}
+
+func formatETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+func parseETag(etag string) (int64, error) {
+	etag = strings.TrimPrefix(etag, "W/")
+	etag = strings.Trim(etag, `"`)
+	version, err := strconv.ParseInt(etag, 10, 64)
+	if err != nil {
+		return 0, errors.New("If-Match should be the ETag returned by GET: " + etag)
+	}
+	return version, nil
+}
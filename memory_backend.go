@@ -0,0 +1,141 @@
+package quokka
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryBackend struct {
+	mutex    *sync.Mutex
+	events   []*Event
+	latest   map[string]*Event
+	versions map[string]map[int64]*Event
+	commands map[string]map[string]*Event
+}
+
+// NewMemoryBackend keeps events in memory, enforcing the same unique constraints as the entity table.
+// It is meant for unit testing and benchmarking handlers without database.
+func NewMemoryBackend() Backend {
+	return &memoryBackend{
+		mutex:    &sync.Mutex{},
+		latest:   map[string]*Event{},
+		versions: map[string]map[int64]*Event{},
+		commands: map[string]map[string]*Event{},
+	}
+}
+
+func (backend *memoryBackend) AppendBatch(events []*Event) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	pendingVersions := map[string]map[int64]bool{}
+	pendingCommands := map[string]map[string]bool{}
+	for _, event := range events {
+		if backend.versions[event.EntityId][event.Version] != nil || pendingVersions[event.EntityId][event.Version] {
+			return versionConflict(fmt.Errorf(
+				"duplicate version %v of entity %v", event.Version, event.EntityId))
+		}
+		if backend.commands[event.EntityId][event.CommandId] != nil || pendingCommands[event.EntityId][event.CommandId] {
+			return duplicateCommand(fmt.Errorf(
+				"duplicate command %v of entity %v", event.CommandId, event.EntityId))
+		}
+		if pendingVersions[event.EntityId] == nil {
+			pendingVersions[event.EntityId] = map[int64]bool{}
+			pendingCommands[event.EntityId] = map[string]bool{}
+		}
+		pendingVersions[event.EntityId][event.Version] = true
+		pendingCommands[event.EntityId][event.CommandId] = true
+	}
+	committedAt := time.Now()
+	for _, event := range events {
+		copied := *event
+		copied.EventId = int64(len(backend.events) + 1)
+		copied.CommittedAt = committedAt
+		backend.events = append(backend.events, &copied)
+		if backend.versions[copied.EntityId] == nil {
+			backend.versions[copied.EntityId] = map[int64]*Event{}
+			backend.commands[copied.EntityId] = map[string]*Event{}
+		}
+		backend.versions[copied.EntityId][copied.Version] = &copied
+		backend.commands[copied.EntityId][copied.CommandId] = &copied
+		latest := backend.latest[copied.EntityId]
+		if latest == nil || latest.Version < copied.Version {
+			backend.latest[copied.EntityId] = &copied
+		}
+	}
+	return nil
+}
+
+func (backend *memoryBackend) GetLatest(entityId string) (*Event, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	event := backend.latest[entityId]
+	if event == nil {
+		return nil, ErrNotFound
+	}
+	return event, nil
+}
+
+func (backend *memoryBackend) GetByCommandId(entityId string, commandId string) (*Event, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	event := backend.commands[entityId][commandId]
+	if event == nil {
+		return nil, ErrNotFound
+	}
+	return event, nil
+}
+
+func (backend *memoryBackend) GetHistory(entityId string) ([]*Event, error) {
+	return backend.GetHistoryFrom(entityId, 0)
+}
+
+func (backend *memoryBackend) GetHistoryFrom(entityId string, fromVersion int64) ([]*Event, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	history := make([]*Event, 0, len(backend.versions[entityId]))
+	for version, event := range backend.versions[entityId] {
+		if version >= fromVersion {
+			history = append(history, event)
+		}
+	}
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Version < history[j].Version
+	})
+	return history, nil
+}
+
+func (backend *memoryBackend) ScanByOffset(offset int64, limit int) ([]*Event, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	// event id is the index + 1
+	if offset < 0 {
+		offset = 0
+	}
+	events := []*Event{}
+	for i := offset; i < int64(len(backend.events)) && len(events) < limit; i++ {
+		// purged event leaves a hole
+		if backend.events[i] != nil {
+			events = append(events, backend.events[i])
+		}
+	}
+	return events, nil
+}
+
+func (backend *memoryBackend) DeleteHistory(entityId string, toVersion int64) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	for version, event := range backend.versions[entityId] {
+		if version > toVersion {
+			continue
+		}
+		backend.events[event.EventId-1] = nil
+		delete(backend.versions[entityId], version)
+		delete(backend.commands[entityId], event.CommandId)
+	}
+	if latest := backend.latest[entityId]; latest != nil && latest.Version <= toVersion {
+		delete(backend.latest, entityId)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"strconv"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+func Test_memory_backend_unique_constraints(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	should.Nil(backend.AppendBatch([]*Event{
+		{EntityId: "a", Version: 1, CommandId: "create"},
+		{EntityId: "a", Version: 2, CommandId: "xxx-001"},
+	}))
+	err := backend.AppendBatch([]*Event{{EntityId: "a", Version: 2, CommandId: "xxx-002"}})
+	should.True(errors.Is(err, ErrVersionConflict))
+	err = backend.AppendBatch([]*Event{{EntityId: "a", Version: 3, CommandId: "xxx-001"}})
+	should.True(errors.Is(err, ErrDuplicateCommand))
+	err = backend.AppendBatch([]*Event{
+		{EntityId: "b", Version: 1, CommandId: "create"},
+		{EntityId: "b", Version: 1, CommandId: "create"},
+	})
+	should.True(errors.Is(err, ErrVersionConflict))
+	_, err = backend.GetLatest("b")
+	should.Equal(ErrNotFound, err)
+	latest, err := backend.GetLatest("a")
+	should.Nil(err)
+	should.Equal(int64(2), latest.Version)
+	events, err := backend.ScanByOffset(1, 10)
+	should.Nil(err)
+	should.Equal(1, len(events))
+	should.Equal(int64(2), events[0].EventId)
+}
+
+func Test_memory_update_should_be_idempotent(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	accountId := NewID().String()
+	worker := accounts.StartBackendWorker(backend)
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	response, err := worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.Equal(0, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	response, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.Equal(0, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	response, err = worker.Handle(accountId, "xxx-002", "transfer1pc", []byte("-200"))
+	should.Nil(err)
+	should.Equal(1, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	account, err := accounts.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(100), account.State.(*Account).UsableBalance)
+}
+
+func Benchmark_memory_transfer(b *testing.B) {
+	backend := NewMemoryBackend()
+	accountId := NewID().String()
+	worker := accounts.StartBackendWorker(backend)
+	worker.Handle(accountId, "create", "create", nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	responsePromises := make([]chan interface{}, 0, b.N)
+	for i := 0; i < b.N; i++ {
+		responsePromises = append(responsePromises,
+			worker.HandleAsync(accountId, strconv.Itoa(i), "transfer1pc", []byte("1")))
+	}
+	for _, responsePromise := range responsePromises {
+		<-responsePromise
+	}
+}
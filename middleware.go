@@ -0,0 +1,28 @@
+package quokka
+
+// CommandContext describes the command being handled, for middleware to make decision
+type CommandContext struct {
+	EntityId    string
+	CommandId   string
+	CommandName string
+	// Version is the current version of the entity, 0 means the entity is being created
+	Version int64
+	Request []byte
+}
+
+// Middleware wraps HandleCommand of every command registered in the store,
+// it can reject the command by returning error without calling handleCommand
+type Middleware func(ctx *CommandContext, handleCommand HandleCommand) HandleCommand
+
+// Use appends middleware, the first one used is the outermost
+func (store *entityStore) Use(middleware Middleware) *entityStore {
+	store.middlewares = append(store.middlewares, middleware)
+	return store
+}
+
+func (store *entityStore) applyMiddlewares(ctx *CommandContext, handleCommand HandleCommand) HandleCommand {
+	for i := len(store.middlewares) - 1; i >= 0; i-- {
+		handleCommand = store.middlewares[i](ctx, handleCommand)
+	}
+	return handleCommand
+}
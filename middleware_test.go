@@ -0,0 +1,40 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"github.com/json-iterator/go/require"
+)
+
+func Test_middleware(t *testing.T) {
+	should := require.New(t)
+	visited := []string{}
+	store := defineAccount(Config{}.Froze().StoreOf("account")).
+		Use(func(ctx *CommandContext, handleCommand HandleCommand) HandleCommand {
+		return func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			visited = append(visited, "outer:"+ctx.CommandName)
+			return handleCommand(request, state)
+		}
+	}).
+		Use(func(ctx *CommandContext, handleCommand HandleCommand) HandleCommand {
+		return func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			visited = append(visited, "inner:"+ctx.CommandName)
+			if ctx.CommandName != "create" && ctx.Version == 0 {
+				return nil, nil, errors.New("entity not created")
+			}
+			if string(ctx.Request) == "0" {
+				return nil, nil, errors.New("amount should not be zero")
+			}
+			return handleCommand(request, state)
+		}
+	})
+	worker := store.StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("0"))
+	should.Equal("amount should not be zero", err.Error())
+	should.Equal([]string{
+		"outer:create", "inner:create",
+		"outer:transfer1pc", "inner:transfer1pc"}, visited)
+}
@@ -0,0 +1,60 @@
+package quokka
+
+import (
+	"strconv"
+)
+
+// SubscriberOffset is the state of the offset entity, the entity id is the subscriber name
+type SubscriberOffset struct {
+	Offset int64
+}
+
+// OffsetStore defines the entity saving the offset of subscribers, see ProcessManager.Checkpoint
+func OffsetStore(entityName string) *entityStore {
+	return ConfigDefault.OffsetStore(entityName)
+}
+
+// OffsetStore defines the entity saving the offset of subscribers, the offset never goes backward
+func (cfg *frozenConfig) OffsetStore(entityName string) *entityStore {
+	return cfg.StoreOf(entityName).
+		StateType(func() interface{} {
+			return &SubscriberOffset{}
+		}).
+		CommandWithMode("advance", CreateIfAbsent,
+			func() interface{} {
+				var offset int64
+				return &offset
+			},
+			func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+				offset := *(request.(*int64))
+				saved, _ := state.(*SubscriberOffset)
+				if saved == nil {
+					saved = &SubscriberOffset{}
+				}
+				if offset > saved.Offset {
+					saved.Offset = offset
+				}
+				return saved, saved, nil
+			})
+}
+
+// loadOffset returns 0 if nothing saved
+func loadOffset(offsets *worker, subscriber string) (int64, error) {
+	entity, err := offsets.store.GetFromBackend(offsets.backend, subscriber)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return entity.State.(*SubscriberOffset).Offset, nil
+}
+
+func saveOffset(offsets *worker, subscriber string, offset int64) error {
+	request, err := offsets.store.codec.Marshal(offset)
+	if err != nil {
+		return err
+	}
+	_, err = offsets.Handle(subscriber, "advance-"+strconv.FormatInt(offset, 10), "advance", request)
+	return err
+}
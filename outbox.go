@@ -0,0 +1,395 @@
+package quokka
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/v2pro/plz"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var dispatchedMessages = plz.Logger("metric", "outbox")
+
+// OutboxMessage is returned by handler in Result, it is stored in the same row of the state,
+// so it is committed if and only if the state is committed
+type OutboxMessage struct {
+	// Sink is the name of sink registered to the dispatcher
+	Sink    string      `json:"sink"`
+	Payload interface{} `json:"payload"`
+}
+
+// OutboxEnvelope is the message delivered to the sink
+type OutboxEnvelope struct {
+	// MessageId is same for every delivery attempt, the sink can use it to drop duplicates
+	MessageId  string
+	EntityName string
+	EntityId   string
+	Version    int64
+	Sink       string
+	// Payload is encoded as json, whatever the codec of the store
+	Payload []byte
+}
+
+// Sink delivers the message to the outside world, returning error means the delivery should be retried
+type Sink interface {
+	Deliver(envelope *OutboxEnvelope) error
+}
+
+// SinkFunc delivers the message by go callback
+type SinkFunc func(envelope *OutboxEnvelope) error
+
+func (sink SinkFunc) Deliver(envelope *OutboxEnvelope) error {
+	return sink(envelope)
+}
+
+// webhookSink has http client of its own, so that the timeout does not affect other http clients
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+// WebhookSink posts the payload to the url, X-Message-Id header is the message id.
+// Response status other than 2xx is error. The request times out in 10 seconds, see Timeout.
+func WebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Timeout limits the whole request, the hung webhook should not block the messages after it forever
+func (sink *webhookSink) Timeout(timeout time.Duration) *webhookSink {
+	sink.client.Timeout = timeout
+	return sink
+}
+
+func (sink *webhookSink) Deliver(envelope *OutboxEnvelope) error {
+	req, err := http.NewRequest("POST", sink.url, bytes.NewReader(envelope.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Message-Id", envelope.MessageId)
+	resp, err := sink.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %v responded %v", sink.url, resp.Status)
+	}
+	return nil
+}
+
+// FileSink appends the message as one json line to the file
+func FileSink(path string) Sink {
+	mutex := &sync.Mutex{}
+	return SinkFunc(func(envelope *OutboxEnvelope) error {
+		line, err := json.Marshal(map[string]interface{}{
+			"message_id":  envelope.MessageId,
+			"entity_name": envelope.EntityName,
+			"entity_id":   envelope.EntityId,
+			"version":     envelope.Version,
+			"payload":     json.RawMessage(envelope.Payload),
+		})
+		if err != nil {
+			return err
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(append(line, '\n'))
+		closeErr := file.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	})
+}
+
+// OutboxDeliveries is the state of the delivery tracking entity, which has same id as the source entity.
+// Messages of the entity are delivered in event id order, so only the messages after DeliveredEventId
+// are tracked one by one, the state does not grow with the messages ever sent.
+// Event id is used instead of version, as versions start over after the entity purged and created again.
+type OutboxDeliveries struct {
+	// DeliveredEventId is the event of source entity of which messages are all delivered
+	DeliveredEventId int64
+	// Messages is keyed by "{event id}-{index}" of the message in the source entity
+	Messages map[string]*OutboxDelivery
+}
+
+type OutboxDelivery struct {
+	EventId     int64
+	Delivered   bool
+	Attempts    int
+	LastError   string
+	AttemptedAt time.Time
+}
+
+type outboxAttempt struct {
+	MessageKey string
+	EventId    int64
+	// Messages is the count of messages of the event
+	Messages    int
+	Error       string
+	AttemptedAt time.Time
+}
+
+// isDelivered tells if the message has been delivered
+func (deliveries *OutboxDeliveries) isDelivered(eventId int64, messageKey string) bool {
+	if eventId <= deliveries.DeliveredEventId {
+		return true
+	}
+	delivery := deliveries.Messages[messageKey]
+	return delivery != nil && delivery.Delivered
+}
+
+func (deliveries *OutboxDeliveries) record(attempt *outboxAttempt) *OutboxDelivery {
+	if attempt.EventId <= deliveries.DeliveredEventId {
+		return &OutboxDelivery{EventId: attempt.EventId, Delivered: true}
+	}
+	delivery := deliveries.Messages[attempt.MessageKey]
+	if delivery == nil {
+		delivery = &OutboxDelivery{EventId: attempt.EventId}
+		deliveries.Messages[attempt.MessageKey] = delivery
+	}
+	delivery.Attempts++
+	delivery.Delivered = attempt.Error == ""
+	delivery.LastError = attempt.Error
+	delivery.AttemptedAt = attempt.AttemptedAt
+	delivered := 0
+	for _, tracked := range deliveries.Messages {
+		if tracked.EventId == attempt.EventId && tracked.Delivered {
+			delivered++
+		}
+	}
+	if delivered < attempt.Messages {
+		return delivery
+	}
+	// all messages of the event delivered, stop tracking them one by one
+	deliveries.DeliveredEventId = attempt.EventId
+	for messageKey, tracked := range deliveries.Messages {
+		if tracked.EventId <= deliveries.DeliveredEventId {
+			delete(deliveries.Messages, messageKey)
+		}
+	}
+	return delivery
+}
+
+// OutboxStore defines the delivery tracking entity, see OutboxDispatcher
+func OutboxStore(entityName string) *entityStore {
+	return ConfigDefault.OutboxStore(entityName)
+}
+
+func (cfg *frozenConfig) OutboxStore(entityName string) *entityStore {
+	return cfg.StoreOf(entityName).
+		StateType(func() interface{} {
+			return &OutboxDeliveries{}
+		}).
+		CommandWithMode("attempt", CreateIfAbsent,
+			func() interface{} {
+				return &outboxAttempt{}
+			},
+			func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+				attempt := request.(*outboxAttempt)
+				deliveries, _ := state.(*OutboxDeliveries)
+				if deliveries == nil {
+					deliveries = &OutboxDeliveries{}
+				}
+				if deliveries.Messages == nil {
+					deliveries.Messages = map[string]*OutboxDelivery{}
+				}
+				return deliveries.record(attempt), deliveries, nil
+			})
+}
+
+// OutboxDispatcher delivers the outbox messages of the source store at least once, in event id order.
+// The delivery of each message is tracked by the worker of OutboxStore, delivered message is not sent again,
+// failed message blocks the messages after it, and is retried until delivered.
+//
+// The offset assumes event id order is commit order. With several workers writing the same table,
+// an event might commit after a greater event id has been dispatched, its messages are then never dispatched.
+// Run one worker per entity table, or dispatch again From an offset before the gap, delivered messages
+// are skipped by the tracking.
+type OutboxDispatcher struct {
+	source  *worker
+	tracker *worker
+	sinks   map[string]Sink
+	offset  int64
+}
+
+// NewOutboxDispatcher takes the started worker of source store and the started worker of OutboxStore
+func NewOutboxDispatcher(source *worker, tracker *worker) *OutboxDispatcher {
+	return &OutboxDispatcher{source: source, tracker: tracker, sinks: map[string]Sink{}}
+}
+
+// Sink registers the sink by name, it should be done before start
+func (dispatcher *OutboxDispatcher) Sink(sinkName string, sink Sink) *OutboxDispatcher {
+	dispatcher.sinks[sinkName] = sink
+	return dispatcher
+}
+
+// From skips the events with event id not greater than offset
+func (dispatcher *OutboxDispatcher) From(offset int64) *OutboxDispatcher {
+	dispatcher.offset = offset
+	return dispatcher
+}
+
+// Offset is the event id of which outbox has been delivered
+func (dispatcher *OutboxDispatcher) Offset() int64 {
+	return atomic.LoadInt64(&dispatcher.offset)
+}
+
+func (dispatcher *OutboxDispatcher) Start() {
+	go func() {
+		for {
+			dispatched, err := dispatcher.DispatchBatch(1000)
+			if err != nil {
+				dispatchedMessages.Error("failed to deliver outbox",
+					"entity_name", dispatcher.source.store.entityName,
+					"offset", dispatcher.Offset(),
+					"error", err)
+			}
+			if dispatched == 0 || err != nil {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// DispatchBatch delivers the outbox of at most limit events after the offset, it stops at the first failure.
+// Events are scanned by event id, see OutboxDispatcher for events committed out of event id order.
+func (dispatcher *OutboxDispatcher) DispatchBatch(limit int) (int, error) {
+	events, err := dispatcher.source.store.Scan(dispatcher.source.backend, dispatcher.Offset(), limit)
+	if err != nil {
+		return 0, err
+	}
+	for i, event := range events {
+		err = dispatcher.dispatch(event)
+		if err != nil {
+			return i, err
+		}
+		atomic.StoreInt64(&dispatcher.offset, event.EventId)
+	}
+	return len(events), nil
+}
+
+// Deliveries returns the delivery state of the outbox messages of the source entity
+func (dispatcher *OutboxDispatcher) Deliveries(entityId string) (*OutboxDeliveries, error) {
+	entity, err := dispatcher.tracker.store.GetFromBackend(dispatcher.tracker.backend, entityId)
+	if errors.Is(err, ErrNotFound) {
+		return &OutboxDeliveries{Messages: map[string]*OutboxDelivery{}}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entity.State.(*OutboxDeliveries), nil
+}
+
+func (dispatcher *OutboxDispatcher) dispatch(event *Event) error {
+	if len(event.Outbox) == 0 {
+		return nil
+	}
+	messages, err := dispatcher.decodeOutbox(event)
+	if err != nil {
+		return err
+	}
+	deliveries, err := dispatcher.Deliveries(event.EntityId)
+	if err != nil {
+		return err
+	}
+	for i, message := range messages {
+		messageKey := strconv.FormatInt(event.EventId, 10) + "-" + strconv.Itoa(i)
+		if deliveries.isDelivered(event.EventId, messageKey) {
+			continue
+		}
+		attempts := 0
+		if delivery := deliveries.Messages[messageKey]; delivery != nil {
+			attempts = delivery.Attempts
+		}
+		deliverErr := dispatcher.deliver(event, messageKey, message)
+		attempt := &outboxAttempt{
+			MessageKey:  messageKey,
+			EventId:     event.EventId,
+			Messages:    len(messages),
+			AttemptedAt: time.Now(),
+		}
+		if deliverErr != nil {
+			attempt.Error = deliverErr.Error()
+		}
+		err = dispatcher.record(event.EntityId, attempt, attempts+1)
+		if deliverErr != nil {
+			return deliverErr
+		}
+		if err != nil {
+			// delivered but not recorded, it will be delivered again
+			return err
+		}
+	}
+	return nil
+}
+
+// encodedOutboxMessage is OutboxMessage with payload encoded as json
+type encodedOutboxMessage struct {
+	Sink    string          `json:"sink"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// decodeOutbox keeps json payload as it is, so that numbers are not rounded by float64
+func (dispatcher *OutboxDispatcher) decodeOutbox(event *Event) ([]encodedOutboxMessage, error) {
+	cfg := dispatcher.source.store.cfg
+	var encoded []encodedOutboxMessage
+	if event.Codec == "" || event.Codec == "json" {
+		err := cfg.jsonApi.Unmarshal(event.Outbox, &encoded)
+		return encoded, err
+	}
+	codec, err := cfg.codecOf(event.Codec)
+	if err != nil {
+		return nil, err
+	}
+	var messages []OutboxMessage
+	err = codec.Unmarshal(event.Outbox, &messages)
+	if err != nil {
+		return nil, err
+	}
+	for _, message := range messages {
+		payload, err := cfg.jsonApi.Marshal(message.Payload)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, encodedOutboxMessage{Sink: message.Sink, Payload: payload})
+	}
+	return encoded, nil
+}
+
+func (dispatcher *OutboxDispatcher) deliver(event *Event, messageKey string, message encodedOutboxMessage) error {
+	sink := dispatcher.sinks[message.Sink]
+	if sink == nil {
+		return fmt.Errorf("sink %v is not registered", message.Sink)
+	}
+	return sink.Deliver(&OutboxEnvelope{
+		MessageId:  dispatcher.source.store.entityName + "-" + event.EntityId + "-" + messageKey,
+		EntityName: dispatcher.source.store.entityName,
+		EntityId:   event.EntityId,
+		Version:    event.Version,
+		Sink:       message.Sink,
+		Payload:    message.Payload,
+	})
+}
+
+// record derives the command id from the message key and the attempt number, so retried record applies once
+func (dispatcher *OutboxDispatcher) record(entityId string, attempt *outboxAttempt, attemptNumber int) error {
+	request, err := dispatcher.tracker.store.codec.Marshal(attempt)
+	if err != nil {
+		return err
+	}
+	commandId := "attempt-" + attempt.MessageKey + "-" + strconv.Itoa(attemptNumber)
+	_, err = dispatcher.tracker.Handle(entityId, commandId, "attempt", request)
+	return err
+}
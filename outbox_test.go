@@ -0,0 +1,149 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+func defineNotifiedAccount(cfg *frozenConfig) *entityStore {
+	return defineAccount(cfg.StoreOf("account")).
+		Command("notify", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account := state.(*Account)
+			return &Result{
+				Response: ResponseMessage{},
+				Outbox: []OutboxMessage{
+					{Sink: "email", Payload: map[string]interface{}{
+						"balance": account.UsableBalance, "notification_id": int64(9007199254740993)}},
+					{Sink: "file", Payload: "notified"},
+				},
+			}, nil, nil
+		})
+}
+
+func Test_outbox(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	worker := defineNotifiedAccount(cfg).StartBackendWorker(NewMemoryBackend())
+	tracker := cfg.OutboxStore("account_outbox").StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "notify", nil)
+	should.Nil(err)
+	dir, err := ioutil.TempDir("", "outbox")
+	should.Nil(err)
+	defer os.RemoveAll(dir)
+	emails := []*OutboxEnvelope{}
+	emailDown := true
+	newDispatcher := func() *OutboxDispatcher {
+		return NewOutboxDispatcher(worker, tracker).
+			Sink("email", SinkFunc(func(envelope *OutboxEnvelope) error {
+			if emailDown {
+				return errors.New("email is down")
+			}
+			emails = append(emails, envelope)
+			return nil
+		})).
+			Sink("file", FileSink(filepath.Join(dir, "outbox.log")))
+	}
+	dispatcher := newDispatcher()
+	dispatched, err := dispatcher.DispatchBatch(100)
+	should.NotNil(err)
+	should.Equal(1, dispatched)
+	deliveries, err := dispatcher.Deliveries(accountId)
+	should.Nil(err)
+	should.Equal(1, deliveries.Messages["2-0"].Attempts)
+	should.False(deliveries.Messages["2-0"].Delivered)
+	should.Equal("email is down", deliveries.Messages["2-0"].LastError)
+	// recording the same attempt again does not count twice
+	should.Nil(dispatcher.record(accountId, &outboxAttempt{
+		MessageKey: "2-0", EventId: 2, Messages: 2, Error: "email is down"}, 1))
+	deliveries, err = dispatcher.Deliveries(accountId)
+	should.Nil(err)
+	should.Equal(1, deliveries.Messages["2-0"].Attempts)
+	emailDown = false
+	dispatched, err = dispatcher.DispatchBatch(100)
+	should.Nil(err)
+	should.Equal(1, dispatched)
+	should.Equal(1, len(emails))
+	should.Equal(accountId, emails[0].EntityId)
+	should.Equal(0, jsoniter.Get(emails[0].Payload, "balance").ToInt())
+	should.Contains(string(emails[0].Payload), "9007199254740993")
+	// delivered messages are not sent again, even if dispatched from the beginning
+	_, err = newDispatcher().DispatchBatch(100)
+	should.Nil(err)
+	should.Equal(1, len(emails))
+	deliveries, err = dispatcher.Deliveries(accountId)
+	should.Nil(err)
+	// messages of the event are all delivered, no longer tracked one by one
+	should.Equal(int64(2), deliveries.DeliveredEventId)
+	should.Equal(0, len(deliveries.Messages))
+	written, err := ioutil.ReadFile(filepath.Join(dir, "outbox.log"))
+	should.Nil(err)
+	should.Equal("notified", jsoniter.Get(written, "payload").ToString())
+}
+
+func Test_outbox_of_entity_created_again_after_purge(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	store := defineNotifiedAccount(cfg).
+		CommandWithMode("close", Delete, nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return "closed", nil, nil
+		})
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	tracker := cfg.OutboxStore("account_outbox").StartBackendWorker(NewMemoryBackend())
+	emails := []*OutboxEnvelope{}
+	dispatcher := NewOutboxDispatcher(worker, tracker).
+		Sink("email", SinkFunc(func(envelope *OutboxEnvelope) error {
+		emails = append(emails, envelope)
+		return nil
+	})).
+		Sink("file", SinkFunc(func(envelope *OutboxEnvelope) error {
+		return nil
+	}))
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "notify-001", "notify", nil)
+	should.Nil(err)
+	_, err = dispatcher.DispatchBatch(100)
+	should.Nil(err)
+	should.Equal(1, len(emails))
+	_, err = worker.Handle(accountId, "close", "close", nil)
+	should.Nil(err)
+	should.Nil(store.PurgeFromBackend(backend, accountId))
+	// same versions again, but new events
+	_, err = worker.Handle(accountId, "create-again", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "notify-002", "notify", nil)
+	should.Nil(err)
+	_, err = dispatcher.DispatchBatch(100)
+	should.Nil(err)
+	should.Equal(2, len(emails))
+	should.NotEqual(emails[0].MessageId, emails[1].MessageId)
+}
+
+func Test_webhook_sink_times_out(t *testing.T) {
+	should := require.New(t)
+	hung := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hung
+	}))
+	defer server.Close()
+	defer close(hung)
+	start := time.Now()
+	err := WebhookSink(server.URL).Timeout(50 * time.Millisecond).Deliver(&OutboxEnvelope{Payload: []byte("{}")})
+	should.NotNil(err)
+	should.True(time.Since(start) < time.Second)
+}
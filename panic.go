@@ -0,0 +1,56 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// PanicError is replied to the command of which handler (or the handling such as encoding and loading) panicked,
+// other commands in the batch are not affected
+type PanicError struct {
+	CommandName string
+	Value       interface{}
+	Stack       []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("quokka: handler of %v panicked: %v", err.CommandName, err.Value)
+}
+
+// callHandler converts the panic of handler into PanicError
+func callHandler(commandName string, handleCommand HandleCommand, request interface{}, state interface{}) (
+	response interface{}, newState interface{}, err error) {
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			response, newState = nil, nil
+			err = &PanicError{CommandName: commandName, Value: recovered, Stack: debug.Stack()}
+		}
+	}()
+	return handleCommand(request, state)
+}
+
+// tryHandleOne converts the panic of handling the command, not only of the handler, into PanicError of the command
+func (worker *worker) tryHandleOne(command *command) (event *Event, err error) {
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			// the cached state might be half updated
+			delete(worker.entityCache, command.entityId)
+			event, err = nil, &PanicError{CommandName: command.commandName, Value: recovered, Stack: debug.Stack()}
+		}
+		var panicErr *PanicError
+		if errors.As(err, &panicErr) {
+			atomic.AddInt64(&worker.stats.handlerPanics, 1)
+			errorLogger.Error("handler panicked",
+				"entity_name", worker.store.entityName,
+				"command_name", command.commandName,
+				"command_id", command.commandId,
+				"panic", panicErr.Value,
+				"stack", string(panicErr.Stack))
+		}
+	}()
+	return worker.handleOne(command)
+}
@@ -0,0 +1,52 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"sync/atomic"
+	"github.com/json-iterator/go/require"
+)
+
+type explodingResponse struct{}
+
+func (response explodingResponse) MarshalJSON() ([]byte, error) {
+	panic("marshal exploded")
+}
+
+func Test_panic_is_isolated(t *testing.T) {
+	testCases := []struct {
+		name    string
+		explode HandleCommand
+		value   interface{}
+	}{
+		{"handler", func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			var account *Account
+			account.UsableBalance++
+			return nil, account, nil
+		}, nil},
+		{"marshal", func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return explodingResponse{}, state, nil
+		}, "marshal exploded"},
+	}
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			should := require.New(t)
+			worker, accountId := startAccount(should, newAccountStore().
+				Command("explode", nil, testCase.explode))
+			exploded := worker.HandleAsync(accountId, "explode-001", "explode", nil)
+			transferred := worker.HandleAsync(accountId, "xxx-001", "transfer1pc", []byte("100"))
+			var panicErr *PanicError
+			should.True(errors.As((<-exploded).(error), &panicErr))
+			should.Equal("explode", panicErr.CommandName)
+			should.NotEmpty(panicErr.Stack)
+			if testCase.value != nil {
+				should.Equal(testCase.value, panicErr.Value)
+			}
+			_, isResponse := (<-transferred).([]byte)
+			should.True(isResponse)
+			_, err := worker.Handle(accountId, "xxx-002", "transfer1pc", []byte("100"))
+			should.Nil(err)
+			should.Equal(int64(1), atomic.LoadInt64(&worker.stats.handlerPanics))
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package quokka
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/lib/pq"
+	"strconv"
+	"strings"
+)
+
+var DialectPostgres Dialect = &postgresDialect{}
+
+// unique_violation, see https://www.postgresql.org/docs/current/errcodes-appendix.html
+const pqUniqueViolation = "23505"
+
+// duplicate_column, only when IF NOT EXISTS is not used
+const pqDuplicateColumn = "42701"
+
+type postgresDialect struct {
+}
+
+func (dialect *postgresDialect) Name() string {
+	return "postgres"
+}
+
+// constraint name is schema wide in postgres, so it is prefixed with the entity name.
+// entity_id is VARCHAR, as CHAR is blank padded when read back
+func (dialect *postgresDialect) CreateTableSql(entityName string, binary bool) string {
+	payloadType := "JSONB"
+	if binary {
+		payloadType = "BYTEA"
+	}
+	return `CREATE TABLE IF NOT EXISTS "` + entityName + `" (
+  event_id     BIGSERIAL    NOT NULL       PRIMARY KEY,
+  entity_id    VARCHAR(256) NOT NULL,
+  version      BIGINT       NOT NULL,
+  command_id   VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      ` + payloadType + `        NULL,
+  response     ` + payloadType + `        NOT NULL,
+  state        ` + payloadType + `        NOT NULL,
+  state_version INT         NOT NULL       DEFAULT 0,
+  events       ` + payloadType + `        NULL,
+  outbox       ` + payloadType + `        NULL,
+  tombstone    SMALLINT     NOT NULL       DEFAULT 0,
+  codec        VARCHAR(32)  NOT NULL       DEFAULT 'json',
+  delta_base   BIGINT       NOT NULL       DEFAULT 0,
+  committed_at TIMESTAMP    NOT NULL       DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT ` + entityName + `_unique_version UNIQUE (entity_id, version),
+  CONSTRAINT ` + entityName + `_unique_command UNIQUE (entity_id, command_id)
+)`
+}
+
+// BinaryColumnsSql keeps the json text as utf8 bytes, use PostgresBinaryDriver after the migration
+func (dialect *postgresDialect) BinaryColumnsSql(entityName string) []string {
+	return []string{`ALTER TABLE "` + entityName + `"
+  ALTER COLUMN request  TYPE BYTEA USING convert_to(request::text, 'UTF8'),
+  ALTER COLUMN response TYPE BYTEA USING convert_to(response::text, 'UTF8'),
+  ALTER COLUMN state    TYPE BYTEA USING convert_to(state::text, 'UTF8'),
+  ALTER COLUMN events   TYPE BYTEA USING convert_to(events::text, 'UTF8'),
+  ALTER COLUMN outbox   TYPE BYTEA USING convert_to(outbox::text, 'UTF8')`}
+}
+
+func (dialect *postgresDialect) UpgradeTableSql(entityName string, binary bool) []string {
+	payloadType := "JSONB"
+	if binary {
+		payloadType = "BYTEA"
+	}
+	return upgradeColumnsSql(`ALTER TABLE "`+entityName+`" ADD COLUMN IF NOT EXISTS`, payloadType, "SMALLINT")
+}
+
+func (dialect *postgresDialect) CreateScheduleTableSql(tableName string, binary bool) string {
+	requestType := "TEXT "
+	if binary {
+		requestType = "BYTEA"
+	}
+	return `CREATE TABLE IF NOT EXISTS "` + tableName + `" (
+  schedule_id  VARCHAR(256) NOT NULL       PRIMARY KEY,
+  entity_name  VARCHAR(256) NOT NULL,
+  entity_id    VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      ` + requestType + `        NULL,
+  due_at       BIGINT       NOT NULL
+)`
+}
+
+func (dialect *postgresDialect) CreateDeadLetterTableSql(tableName string, binary bool) string {
+	requestType := "TEXT "
+	if binary {
+		requestType = "BYTEA"
+	}
+	return `CREATE TABLE IF NOT EXISTS "` + tableName + `" (
+  letter_id       VARCHAR(768) NOT NULL       PRIMARY KEY,
+  entity_name     VARCHAR(256) NOT NULL,
+  entity_id       VARCHAR(256) NOT NULL,
+  command_id      VARCHAR(256) NOT NULL,
+  command_name    VARCHAR(256) NOT NULL,
+  request         ` + requestType + `        NULL,
+  expected_version BIGINT       NOT NULL DEFAULT -1,
+  error           TEXT         NOT NULL,
+  attempts        INT          NOT NULL,
+  first_failed_at BIGINT       NOT NULL,
+  last_failed_at  BIGINT       NOT NULL
+)`
+}
+
+func (dialect *postgresDialect) InsertSql(entityName string) string {
+	return "INSERT INTO " + entityName + " :INSERT_COLUMNS"
+}
+
+func (dialect *postgresDialect) BatchInsertSql(entityName string) string {
+	return "INSERT INTO " + entityName + " :BATCH_INSERT_COLUMNS"
+}
+
+func (dialect *postgresDialect) GetLatestStateSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id ORDER BY version DESC LIMIT 1"
+}
+
+func (dialect *postgresDialect) GetEventSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND command_id=:command_id"
+}
+
+func (dialect *postgresDialect) GetHistorySql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND version>=:version ORDER BY version"
+}
+
+func (dialect *postgresDialect) DeleteHistorySql(entityName string) string {
+	return "DELETE FROM " + entityName + " WHERE entity_id=:entity_id AND version<=:version"
+}
+
+func (dialect *postgresDialect) ScanSql(entityName string) string {
+	return "SELECT * FROM " + entityName + " WHERE event_id>:offset ORDER BY event_id LIMIT :limit"
+}
+
+func (dialect *postgresDialect) TranslateError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) {
+		return err
+	}
+	if pqErr.Code == pqDuplicateColumn {
+		return fmt.Errorf("%w: %v", ErrDuplicateColumn, err)
+	}
+	if pqErr.Code != pqUniqueViolation {
+		return err
+	}
+	if strings.HasSuffix(pqErr.Constraint, "unique_version") {
+		return versionConflict(err)
+	}
+	if strings.HasSuffix(pqErr.Constraint, "unique_command") {
+		return duplicateCommand(err)
+	}
+	return err
+}
+
+// PostgresDriver wraps lib/pq driver to accept the "?" placeholders generated by plz sql,
+// and to send []byte as text, so that they can be stored into JSONB columns
+func PostgresDriver() driver.Driver {
+	return &postgresDriver{&pq.Driver{}, true}
+}
+
+// PostgresBinaryDriver is PostgresDriver for BYTEA columns, used with binary codec
+func PostgresBinaryDriver() driver.Driver {
+	return &postgresDriver{&pq.Driver{}, false}
+}
+
+type postgresDriver struct {
+	driver.Driver
+	bytesAsText bool
+}
+
+func (drv *postgresDriver) Open(name string) (driver.Conn, error) {
+	conn, err := drv.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresConn{conn, drv.bytesAsText}, nil
+}
+
+type postgresConn struct {
+	driver.Conn
+	bytesAsText bool
+}
+
+func (conn *postgresConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := conn.Conn.Prepare(rebindPostgres(query))
+	if err != nil {
+		return nil, err
+	}
+	if !conn.bytesAsText {
+		return stmt, nil
+	}
+	return &postgresStmt{stmt}, nil
+}
+
+type postgresStmt struct {
+	driver.Stmt
+}
+
+func (stmt *postgresStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return stmt.Stmt.Exec(bytesAsText(args))
+}
+
+func (stmt *postgresStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return stmt.Stmt.Query(bytesAsText(args))
+}
+
+// bytesAsText keeps nil as NULL, as empty string is not valid JSONB
+func bytesAsText(args []driver.Value) []driver.Value {
+	converted := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if bytes, isBytes := arg.([]byte); isBytes {
+			if bytes == nil {
+				converted[i] = nil
+			} else {
+				converted[i] = string(bytes)
+			}
+		} else {
+			converted[i] = arg
+		}
+	}
+	return converted
+}
+
+// rebindPostgres replaces ? with $1, $2 ... except the ones quoted in string literal or identifier
+func rebindPostgres(query string) string {
+	rebound := make([]byte, 0, len(query)+16)
+	var quote byte
+	index := 0
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '?':
+			index++
+			rebound = append(rebound, '$')
+			rebound = strconv.AppendInt(rebound, int64(index), 10)
+			continue
+		}
+		rebound = append(rebound, c)
+	}
+	return string(rebound)
+}
@@ -0,0 +1,227 @@
+package quokka
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/v2pro/plz"
+	"sync/atomic"
+	"time"
+)
+
+var processedEvents = plz.Logger("metric", "process_manager")
+
+// ProcessCommand is the follow-up command issued by the process manager
+type ProcessCommand struct {
+	EntityName  string
+	EntityId    string
+	CommandName string
+	// Request is encoded by the codec of the target store
+	Request []byte
+}
+
+// React decides the follow-up commands of the committed event, it should be deterministic,
+// as the event might be reacted again after restart or failure.
+// The event is with full state, use DomainEventsOf to decode the domain events.
+// Error of React is not retried, the event is skipped.
+type React func(event *Event) ([]ProcessCommand, error)
+
+// ProcessManager subscribes to the committed events of the source store, in commit order,
+// and sends the follow-up commands to the workers of target stores started by the same config.
+// Command id is derived from the source event, so that sending again never applies twice.
+//
+// Transient error (see IsTransient) stops the batch, the event is retried from there.
+// Command rejected by the target is not retried, it is recorded by the dead letter backend if set,
+// the event is not blocked by it.
+type ProcessManager struct {
+	name        string
+	source      *worker
+	react       React
+	offset      int64
+	deadLetters DeadLetterBackend
+	checkpoint  *worker
+	saved       int64
+}
+
+// NewProcessManager subscribes to the backend of the source worker, the name is part of the command id,
+// it should be unique among process managers subscribing to the same store
+func NewProcessManager(name string, source *worker, react React) *ProcessManager {
+	return &ProcessManager{name: name, source: source, react: react}
+}
+
+// From skips the events with event id not greater than offset, which has been processed before
+func (pm *ProcessManager) From(offset int64) *ProcessManager {
+	pm.offset = offset
+	return pm
+}
+
+// DeadLetter records the rejected commands, the backend is registered to the config of the source store,
+// so the letters can be replayed by the admin api
+func (pm *ProcessManager) DeadLetter(backend DeadLetterBackend) *ProcessManager {
+	pm.source.store.cfg.registerDeadLetters(backend)
+	pm.deadLetters = backend
+	return pm
+}
+
+// Checkpoint saves the offset after every batch into the started worker of OffsetStore,
+// the entity id is the name of the process manager. Start continues from the saved offset.
+func (pm *ProcessManager) Checkpoint(offsets *worker) *ProcessManager {
+	pm.checkpoint = offsets
+	return pm
+}
+
+// Offset is the event id processed, it can be saved to start from after restart.
+// Starting from 0 is also correct, only slower.
+func (pm *ProcessManager) Offset() int64 {
+	return atomic.LoadInt64(&pm.offset)
+}
+
+// Start polls the source in the background, it continues from the checkpoint if saved.
+// Event failed with transient error is retried until succeeded.
+func (pm *ProcessManager) Start() {
+	go func() {
+		for {
+			err := pm.restore()
+			if err == nil {
+				break
+			}
+			processedEvents.Error("failed to restore offset",
+				"process_manager", pm.name,
+				"error", err)
+			time.Sleep(time.Second)
+		}
+		for {
+			processed, err := pm.ProcessBatch(1000)
+			if err != nil {
+				processedEvents.Error("failed to process event",
+					"process_manager", pm.name,
+					"offset", pm.Offset(),
+					"error", err)
+			}
+			if processed == 0 || err != nil {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// ProcessBatch reacts to at most limit events after the offset, it stops at the first transient failure
+func (pm *ProcessManager) ProcessBatch(limit int) (int, error) {
+	events, err := pm.source.store.Scan(pm.source.backend, pm.Offset(), limit)
+	if err != nil {
+		return 0, err
+	}
+	for i, event := range events {
+		err = pm.process(event)
+		if err != nil {
+			pm.save()
+			return i, err
+		}
+		atomic.StoreInt64(&pm.offset, event.EventId)
+	}
+	return len(events), pm.save()
+}
+
+func (pm *ProcessManager) process(event *Event) error {
+	commands, err := pm.react(event)
+	if err != nil {
+		processedEvents.Error("skipped event failed to react",
+			"process_manager", pm.name,
+			"entity_id", event.EntityId,
+			"version", event.Version,
+			"error", err)
+		return nil
+	}
+	for i, cmd := range commands {
+		target := pm.source.store.cfg.workerOf(cmd.EntityName)
+		if target == nil {
+			return fmt.Errorf("no worker started for entity: %v", cmd.EntityName)
+		}
+		commandId := pm.commandIdOf(event, i)
+		_, err = target.Handle(cmd.EntityId, commandId, cmd.CommandName, cmd.Request)
+		if err == nil {
+			continue
+		}
+		err = fmt.Errorf("failed to send %v to %v %v: %w", cmd.CommandName, cmd.EntityName, cmd.EntityId, err)
+		if IsTransient(err) {
+			return err
+		}
+		pm.reject(cmd, commandId, err)
+	}
+	return nil
+}
+
+// reject records the command not to be retried, the error of recording is only logged
+func (pm *ProcessManager) reject(cmd ProcessCommand, commandId string, err error) {
+	processedEvents.Error("rejected command",
+		"process_manager", pm.name,
+		"command_id", commandId,
+		"error", err)
+	if pm.deadLetters == nil {
+		return
+	}
+	now := time.Now()
+	recordErr := pm.deadLetters.Record(&DeadLetter{
+		LetterId:        deadLetterIdOf(cmd.EntityName, cmd.EntityId, commandId),
+		EntityName:      cmd.EntityName,
+		EntityId:        cmd.EntityId,
+		CommandId:       commandId,
+		CommandName:     cmd.CommandName,
+		Request:         cmd.Request,
+		ExpectedVersion: AnyVersion,
+		Error:           err.Error(),
+		Attempts:        1,
+		FirstFailedAt:   now,
+		LastFailedAt:    now,
+	})
+	if recordErr != nil {
+		errorLogger.Error("failed to record dead letter",
+			"process_manager", pm.name,
+			"command_id", commandId,
+			"error", recordErr)
+	}
+}
+
+// commandIdOf uses event id instead of version, as versions start over after the entity purged and created again.
+// The parts are length prefixed before hashed, so that the dash in names does not make two commands same,
+// and the command id is not longer than the column no matter how long the entity id is.
+func (pm *ProcessManager) commandIdOf(event *Event, index int) string {
+	hash := sha256.New()
+	for _, part := range []string{pm.name, pm.source.store.entityName, event.EntityId} {
+		binary.Write(hash, binary.BigEndian, int64(len(part)))
+		hash.Write([]byte(part))
+	}
+	binary.Write(hash, binary.BigEndian, event.EventId)
+	binary.Write(hash, binary.BigEndian, int64(index))
+	return "pm-" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// restore continues from the checkpoint, if it is ahead of the current offset
+func (pm *ProcessManager) restore() error {
+	if pm.checkpoint == nil {
+		return nil
+	}
+	saved, err := loadOffset(pm.checkpoint, pm.name)
+	if err != nil {
+		return err
+	}
+	if saved > pm.Offset() {
+		atomic.StoreInt64(&pm.offset, saved)
+	}
+	pm.saved = saved
+	return nil
+}
+
+func (pm *ProcessManager) save() error {
+	offset := pm.Offset()
+	if pm.checkpoint == nil || offset <= pm.saved {
+		return nil
+	}
+	err := saveOffset(pm.checkpoint, pm.name, offset)
+	if err != nil {
+		return err
+	}
+	pm.saved = offset
+	return nil
+}
@@ -0,0 +1,137 @@
+package quokka
+
+import (
+	"testing"
+	"github.com/json-iterator/go/require"
+)
+
+type OrderPlaced struct {
+	WalletId string
+	Amount   int64
+}
+
+func Test_process_manager(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	orders := cfg.StoreOf("order").
+		Command("create",
+		func() interface{} {
+			return &OrderPlaced{}
+		},
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return &Result{
+				Response: ResponseMessage{},
+				Events:   []DomainEvent{{"OrderPlaced", request}},
+			}, request, nil
+		})
+	orderWorker := orders.StartBackendWorker(NewMemoryBackend())
+	wallets := defineAccount(cfg.StoreOf("wallet"))
+	walletBackend := NewMemoryBackend()
+	walletWorker := wallets.StartBackendWorker(walletBackend)
+	walletId := NewID().String()
+	_, err := walletWorker.Handle(walletId, "create", "create", nil)
+	should.Nil(err)
+	react := func(event *Event) ([]ProcessCommand, error) {
+		domainEvents, err := orders.DomainEventsOf(event)
+		if err != nil {
+			return nil, err
+		}
+		commands := []ProcessCommand{}
+		for _, domainEvent := range domainEvents {
+			if domainEvent.Name != "OrderPlaced" {
+				continue
+			}
+			payload := domainEvent.Payload.(map[string]interface{})
+			commands = append(commands, ProcessCommand{
+				EntityName:  "wallet",
+				EntityId:    payload["WalletId"].(string),
+				CommandName: "transfer1pc",
+				Request:     []byte("100"),
+			}, ProcessCommand{
+				EntityName:  "wallet",
+				EntityId:    payload["WalletId"].(string),
+				CommandName: "transfer1pc",
+				Request:     []byte("-10"),
+			})
+		}
+		return commands, nil
+	}
+	_, err = orderWorker.Handle(NewID().String(), "create", "create", []byte(`{"WalletId":"`+walletId+`","Amount":10}`))
+	should.Nil(err)
+	_, err = orderWorker.Handle(NewID().String(), "create", "create", []byte(`{"WalletId":"`+walletId+`","Amount":10}`))
+	should.Nil(err)
+	pm := NewProcessManager("payment", orderWorker, react)
+	processed, err := pm.ProcessBatch(100)
+	should.Nil(err)
+	should.Equal(2, processed)
+	should.Equal(int64(2), pm.Offset())
+	// process again from the beginning, as if the offset was lost
+	processed, err = NewProcessManager("payment", orderWorker, react).ProcessBatch(100)
+	should.Nil(err)
+	should.Equal(2, processed)
+	wallet, err := wallets.GetFromBackend(walletBackend, walletId)
+	should.Nil(err)
+	should.Equal(int64(180), wallet.State.(*Account).UsableBalance)
+	should.Equal(int64(5), wallet.Version)
+}
+
+func Test_process_manager_skips_rejected_command(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	orderWorker := cfg.StoreOf("order").
+		Command("create", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return ResponseMessage{}, map[string]interface{}{}, nil
+		}).StartBackendWorker(NewMemoryBackend())
+	walletWorker := defineAccount(cfg.StoreOf("wallet")).StartBackendWorker(NewMemoryBackend())
+	walletId := NewID().String()
+	_, err := walletWorker.Handle(walletId, "create", "create", nil)
+	should.Nil(err)
+	orderIds := []string{NewID().String(), NewID().String()}
+	for _, orderId := range orderIds {
+		_, err = orderWorker.Handle(orderId, "create", "create", nil)
+		should.Nil(err)
+	}
+	react := func(event *Event) ([]ProcessCommand, error) {
+		// the first order pays by the wallet not exist
+		targetId := walletId
+		if event.EntityId == orderIds[0] {
+			targetId = "not-exist"
+		}
+		return []ProcessCommand{{EntityName: "wallet", EntityId: targetId, CommandName: "transfer1pc", Request: []byte("100")}}, nil
+	}
+	deadLetters := NewMemoryDeadLetterBackend()
+	offsets := cfg.OffsetStore("offset").StartBackendWorker(NewMemoryBackend())
+	processed, err := NewProcessManager("payment", orderWorker, react).
+		DeadLetter(deadLetters).Checkpoint(offsets).ProcessBatch(100)
+	should.Nil(err)
+	should.Equal(2, processed)
+	letters, err := deadLetters.List("wallet", 100)
+	should.Nil(err)
+	should.Equal(1, len(letters))
+	should.Equal("not-exist", letters[0].EntityId)
+	// visible to the admin api, though no worker records dead letters
+	letters, err = cfg.listDeadLetters("wallet", 100)
+	should.Nil(err)
+	should.Equal(1, len(letters))
+	wallet, err := walletWorker.store.GetFromBackend(walletWorker.backend, walletId)
+	should.Nil(err)
+	should.Equal(int64(100), wallet.State.(*Account).UsableBalance)
+	// restarted process manager continues from the checkpoint
+	restarted := NewProcessManager("payment", orderWorker, react).Checkpoint(offsets)
+	should.Nil(restarted.restore())
+	should.Equal(int64(2), restarted.Offset())
+}
+
+func Test_process_command_id_is_unambiguous(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	pm1 := NewProcessManager("audit-order", &worker{store: cfg.StoreOf("wallet")}, nil)
+	pm2 := NewProcessManager("audit", &worker{store: cfg.StoreOf("order-wallet")}, nil)
+	event := &Event{EventId: 2, EntityId: "w1", Version: 1}
+	should.NotEqual(pm1.commandIdOf(event, 0), pm2.commandIdOf(event, 0))
+	should.Equal(pm1.commandIdOf(event, 0), pm1.commandIdOf(&Event{EventId: 2, EntityId: "w1", Version: 1}, 0))
+	// same version of the entity created again after purge is another event
+	should.NotEqual(pm1.commandIdOf(event, 0), pm1.commandIdOf(&Event{EventId: 5, EntityId: "w1", Version: 1}, 0))
+	should.NotEqual(pm1.commandIdOf(event, 0), pm1.commandIdOf(event, 1))
+}
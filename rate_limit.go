@@ -0,0 +1,217 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"github.com/v2pro/plz"
+	"github.com/v2pro/plz/log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var rateLimitedCommands = plz.Logger("metric", "rate_limit")
+
+// ErrRateLimited is matched by errors.Is for every RateLimitError
+var ErrRateLimited = errors.New("quokka: rate limited")
+
+// RateLimitError is returned when the command is rejected by the token bucket, before entering the command queue
+type RateLimitError struct {
+	// Limit is the bucket rejected the command, like "prefix:abc", "tenant:abc" or "command:transfer"
+	Limit string
+	// RetryAfter is the time until the bucket has one token again
+	RetryAfter time.Duration
+}
+
+func (err *RateLimitError) Error() string {
+	return fmt.Sprintf("quokka: rate limited by %v, retry after %v", err.Limit, err.RetryAfter)
+}
+
+func (err *RateLimitError) Is(target error) bool {
+	return target == ErrRateLimited
+}
+
+type rateLimit struct {
+	perSecond float64
+	burst     int
+}
+
+// newRateLimit panics on the limit never refilled, the misconfiguration should fail at startup
+func newRateLimit(perSecond float64, burst int) rateLimit {
+	if !(perSecond > 0) || burst < 1 {
+		panic(fmt.Sprintf("invalid rate limit: %v per second with burst %v", perSecond, burst))
+	}
+	return rateLimit{perSecond: perSecond, burst: burst}
+}
+
+type tenantRateLimit struct {
+	tenantOf func(entityId string) string
+	rateLimit
+}
+
+// RateLimitPrefix limits the commands of the entities with id starting with the prefix, they share one bucket.
+// If several prefixes match, the longest one is used. Empty prefix limits the whole store.
+// Only TryHandle, TryHandleAsync and the http api are limited, Handle and HandleAsync bypass the limit.
+func (store *entityStore) RateLimitPrefix(prefix string, perSecond float64, burst int) *entityStore {
+	store.prefixRateLimits[prefix] = newRateLimit(perSecond, burst)
+	return store
+}
+
+// RateLimitTenant gives every tenant a bucket of its own, tenant is extracted from the entity id.
+// Empty tenant is not limited.
+// Only TryHandle, TryHandleAsync and the http api are limited, Handle and HandleAsync bypass the limit.
+func (store *entityStore) RateLimitTenant(tenantOf func(entityId string) string, perSecond float64, burst int) *entityStore {
+	store.tenantRateLimit = &tenantRateLimit{
+		tenantOf:  tenantOf,
+		rateLimit: newRateLimit(perSecond, burst),
+	}
+	return store
+}
+
+// CommandRateLimit limits the command name across all entities.
+// Only TryHandle, TryHandleAsync and the http api are limited, Handle and HandleAsync bypass the limit.
+func (store *entityStore) CommandRateLimit(commandName string, perSecond float64, burst int) *entityStore {
+	store.commandRateLimits[commandName] = newRateLimit(perSecond, burst)
+	return store
+}
+
+// maxRejectedTenants bounds the tenants reported by the admin api, others are counted as rejectedOtherTenants
+const maxRejectedTenants = 100
+
+const rejectedOtherTenants = "tenant:*"
+
+type tokenBucket struct {
+	limit     rateLimit
+	tokens    float64
+	updatedAt time.Time
+}
+
+// rateLimiter keeps the buckets of one worker, it is called by the goroutines sending commands.
+// Bucket refilled to full burst is same as a new one, it is evicted so that buckets of tenants do not pile up.
+type rateLimiter struct {
+	mutex     *sync.Mutex
+	buckets   map[string]*tokenBucket
+	evictedAt time.Time
+	// rejected is keyed by the limit, for the admin api
+	rejected        map[string]int64
+	rejectedTenants int
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		mutex:    &sync.Mutex{},
+		buckets:  map[string]*tokenBucket{},
+		rejected: map[string]int64{},
+	}
+}
+
+// checkRateLimits takes one token from every matched bucket, or none of them if any bucket is empty
+func (worker *worker) checkRateLimits(cmd *command, now time.Time) error {
+	store := worker.store
+	if len(store.prefixRateLimits) == 0 && store.tenantRateLimit == nil && len(store.commandRateLimits) == 0 {
+		return nil
+	}
+	keys := []string{}
+	limits := []rateLimit{}
+	matchedPrefix, found := "", false
+	for prefix := range store.prefixRateLimits {
+		if strings.HasPrefix(cmd.entityId, prefix) && (!found || len(prefix) > len(matchedPrefix)) {
+			matchedPrefix, found = prefix, true
+		}
+	}
+	if found {
+		keys = append(keys, "prefix:"+matchedPrefix)
+		limits = append(limits, store.prefixRateLimits[matchedPrefix])
+	}
+	if store.tenantRateLimit != nil {
+		if tenant := store.tenantRateLimit.tenantOf(cmd.entityId); tenant != "" {
+			keys = append(keys, "tenant:"+tenant)
+			limits = append(limits, store.tenantRateLimit.rateLimit)
+		}
+	}
+	if limit, found := store.commandRateLimits[cmd.commandName]; found {
+		keys = append(keys, "command:"+cmd.commandName)
+		limits = append(limits, limit)
+	}
+	limiter := worker.rateLimiter
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	buckets := make([]*tokenBucket, len(keys))
+	for i, key := range keys {
+		bucket := limiter.buckets[key]
+		if bucket == nil {
+			bucket = &tokenBucket{limit: limits[i], tokens: float64(limits[i].burst), updatedAt: now}
+			limiter.buckets[key] = bucket
+		}
+		bucket.refill(now)
+		if bucket.tokens < 1 {
+			limiter.reject(key)
+			err := &RateLimitError{Limit: key, RetryAfter: bucket.retryAfter()}
+			if rateLimitedCommands.ShouldLog(log.LEVEL_DEBUG) {
+				rateLimitedCommands.Debug("rate limited command",
+					"entity_name", store.entityName,
+					"entity_id", cmd.entityId,
+					"command_name", cmd.commandName,
+					"limit", key)
+			}
+			return err
+		}
+		buckets[i] = bucket
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	limiter.evictFull(now)
+	return nil
+}
+
+// evictFull removes the buckets refilled to full burst, at most once per second
+func (limiter *rateLimiter) evictFull(now time.Time) {
+	if now.Sub(limiter.evictedAt) < time.Second {
+		return
+	}
+	limiter.evictedAt = now
+	for key, bucket := range limiter.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.burst) {
+			delete(limiter.buckets, key)
+		}
+	}
+}
+
+func (limiter *rateLimiter) reject(key string) {
+	if _, found := limiter.rejected[key]; !found && strings.HasPrefix(key, "tenant:") {
+		if limiter.rejectedTenants >= maxRejectedTenants {
+			key = rejectedOtherTenants
+		} else {
+			limiter.rejectedTenants++
+		}
+	}
+	limiter.rejected[key]++
+}
+
+func (bucket *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(bucket.updatedAt).Seconds()
+	if elapsed > 0 {
+		bucket.tokens += elapsed * bucket.limit.perSecond
+		bucket.updatedAt = now
+	}
+	if bucket.tokens > float64(bucket.limit.burst) {
+		bucket.tokens = float64(bucket.limit.burst)
+	}
+}
+
+// retryAfter is positive, as the rate is checked by newRateLimit
+func (bucket *tokenBucket) retryAfter() time.Duration {
+	return time.Duration((1 - bucket.tokens) / bucket.limit.perSecond * float64(time.Second))
+}
+
+func (limiter *rateLimiter) status() map[string]int64 {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	status := map[string]int64{}
+	for key, rejected := range limiter.rejected {
+		status[key] = rejected
+	}
+	return status
+}
@@ -0,0 +1,100 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"github.com/json-iterator/go/require"
+)
+
+func Test_rate_limit_per_tenant(t *testing.T) {
+	should := require.New(t)
+	worker := newAccountStore().
+		RateLimitTenant(func(entityId string) string {
+		return strings.Split(entityId, "/")[0]
+	}, 0.001, 2).
+		StartBackendWorker(NewMemoryBackend())
+	_, err := worker.TryHandle("tenant1/account1", "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.TryHandle("tenant1/account2", "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.TryHandle("tenant1/account3", "create", "create", nil)
+	should.True(errors.Is(err, ErrRateLimited))
+	var rateLimitError *RateLimitError
+	should.True(errors.As(err, &rateLimitError))
+	should.Equal("tenant:tenant1", rateLimitError.Limit)
+	should.True(rateLimitError.RetryAfter > 0)
+	recorder := httptest.NewRecorder()
+	writeHttpError(recorder, err)
+	should.Equal(http.StatusTooManyRequests, recorder.Code)
+	should.NotEqual("", recorder.Header().Get("Retry-After"))
+	// other tenant has its own bucket
+	_, err = worker.TryHandleAsync("tenant2/account1", "create", "create", nil)
+	should.Nil(err)
+	should.Equal(int64(1), worker.status().RateLimited["tenant:tenant1"])
+	// internal traffic is not limited
+	_, err = worker.Handle("tenant1/account3", "create", "create", nil)
+	should.Nil(err)
+}
+
+func Test_rate_limiter_is_bounded(t *testing.T) {
+	should := require.New(t)
+	worker := newAccountStore().
+		RateLimitTenant(func(entityId string) string {
+		return strings.Split(entityId, "/")[0]
+	}, 1, 1).
+		StartBackendWorker(NewMemoryBackend())
+	now := time.Now()
+	for i := 0; i < maxRejectedTenants+10; i++ {
+		cmd := &command{entityId: fmt.Sprintf("tenant%v/account1", i), commandName: "create"}
+		should.Nil(worker.checkRateLimits(cmd, now))
+		should.True(errors.Is(worker.checkRateLimits(cmd, now), ErrRateLimited))
+	}
+	status := worker.rateLimiter.status()
+	should.Equal(maxRejectedTenants+1, len(status))
+	should.Equal(int64(10), status[rejectedOtherTenants])
+	// buckets refilled to full burst are evicted
+	cmd := &command{entityId: "tenant0/account1", commandName: "create"}
+	should.Nil(worker.checkRateLimits(cmd, now.Add(2*time.Second)))
+	should.Equal(1, len(worker.rateLimiter.buckets))
+}
+
+func Test_rate_limit_per_prefix_and_command(t *testing.T) {
+	should := require.New(t)
+	worker := newAccountStore().
+		RateLimitPrefix("", 0.001, 100).
+		RateLimitPrefix("vip-", 0.001, 1).
+		CommandRateLimit("transfer1pc", 0.001, 1).
+		StartBackendWorker(NewMemoryBackend())
+	_, err := worker.TryHandle("vip-1", "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.TryHandle("vip-2", "create", "create", nil)
+	var rateLimitError *RateLimitError
+	should.True(errors.As(err, &rateLimitError))
+	should.Equal("prefix:vip-", rateLimitError.Limit)
+	_, err = worker.TryHandle("normal-1", "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.TryHandle("normal-1", "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	_, err = worker.TryHandle("normal-1", "xxx-002", "transfer1pc", []byte("100"))
+	should.True(errors.As(err, &rateLimitError))
+	should.Equal("command:transfer1pc", rateLimitError.Limit)
+	// the rejected command does not take the token of the prefix bucket
+	should.Equal(98, int(worker.rateLimiter.buckets["prefix:"].tokens))
+}
+
+func Test_rate_limit_must_refill(t *testing.T) {
+	should := require.New(t)
+	for _, perSecond := range []float64{0, -1} {
+		func() {
+			defer func() {
+				should.NotNil(recover())
+			}()
+			newAccountStore().CommandRateLimit("transfer1pc", perSecond, 1)
+		}()
+	}
+}
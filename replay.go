@@ -0,0 +1,144 @@
+package quokka
+
+import (
+	"bytes"
+	"reflect"
+	"github.com/v2pro/plz/sql"
+)
+
+// ReplayReport tells how the recomputed history differs from the stored one
+type ReplayReport struct {
+	EntityId string
+	// ReplayedVersion is the last version replayed
+	ReplayedVersion int64
+	// StateJson is the recomputed state at ReplayedVersion
+	StateJson   []byte
+	Divergences []Divergence
+}
+
+// Divergence is one version where recomputed response or state is not same as stored.
+// StoredState is upcasted to the current state version and the store codec before comparison.
+// If handler failed in replay, Error is set and the stored state is used to continue.
+type Divergence struct {
+	Version          int64
+	CommandId        string
+	CommandName      string
+	StoredResponse   []byte
+	ReplayedResponse []byte
+	StoredState      []byte
+	ReplayedState    []byte
+	Error            error
+}
+
+// Replay re-runs the stored requests through the currently registered handlers,
+// in version order from an empty state. toVersion 0 means replay to the latest version.
+// Like the worker, the state starts over as empty after tombstone and for creating command.
+// Middlewares are not applied, they might reject or change the commands by current time or load.
+// Nothing is written, the report can be used to locate the version where handler bug corrupted the state.
+func (store *entityStore) Replay(conn sql.Conn, entityId string, toVersion int64) (*ReplayReport, error) {
+	return store.ReplayFromBackend(store.SqlBackend(conn), entityId, toVersion)
+}
+
+func (store *entityStore) ReplayFromBackend(backend Backend, entityId string, toVersion int64) (*ReplayReport, error) {
+	history, err := store.History(backend, entityId)
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, ErrNotFound
+	}
+	report := &ReplayReport{EntityId: entityId}
+	entity := &Entity{EntityId: entityId}
+	for _, stored := range history {
+		if toVersion > 0 && stored.Version > toVersion {
+			break
+		}
+		request, err := store.transcode(stored.Codec, stored.Request)
+		if err != nil {
+			return nil, err
+		}
+		mode := store.commandModes[stored.CommandName]
+		if mode == MustNotExist || (mode == CreateIfAbsent && entity.Deleted) {
+			entity = &Entity{EntityId: entityId, Version: entity.Version}
+		}
+		replayed, newState, err := store.execute(entity, stored.CommandId, stored.CommandName, request, false, nil)
+		if err != nil {
+			report.Divergences = append(report.Divergences, Divergence{
+				Version:        stored.Version,
+				CommandId:      stored.CommandId,
+				CommandName:    stored.CommandName,
+				StoredResponse: stored.Response,
+				StoredState:    stored.State,
+				Error:          err,
+			})
+			entity, err = store.entityOf(stored)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		var storedState []byte
+		if stored.Tombstone {
+			// tombstone has no state to upcast
+			storedState, err = store.transcode(stored.Codec, stored.State)
+		} else {
+			storedState, err = store.upcast(stored.Codec, stored.StateVersion, stored.State)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !store.payloadEqual(stored.Codec, stored.Response, store.codecName, replayed.Response) ||
+			!store.payloadEqual(store.codecName, storedState, store.codecName, replayed.State) {
+			report.Divergences = append(report.Divergences, Divergence{
+				Version:          stored.Version,
+				CommandId:        stored.CommandId,
+				CommandName:      stored.CommandName,
+				StoredResponse:   stored.Response,
+				ReplayedResponse: replayed.Response,
+				StoredState:      storedState,
+				ReplayedState:    replayed.State,
+			})
+		}
+		if replayed.Tombstone {
+			entity = &Entity{EntityId: entityId, Version: stored.Version, Deleted: true}
+			continue
+		}
+		if newState != nil {
+			entity.State = newState
+		}
+		entity.StateJson = replayed.State
+		entity.Version = stored.Version
+	}
+	report.ReplayedVersion = entity.Version
+	report.StateJson = entity.StateJson
+	return report, nil
+}
+
+// payloadEqual ignores the difference in codec, formatting and object key order
+func (store *entityStore) payloadEqual(codec1 string, payload1 []byte, codec2 string, payload2 []byte) bool {
+	if codec1 == codec2 && bytes.Equal(payload1, payload2) {
+		return true
+	}
+	obj1, err := store.normalize(codec1, payload1)
+	if err != nil {
+		return false
+	}
+	obj2, err := store.normalize(codec2, payload2)
+	if err != nil {
+		return false
+	}
+	return reflect.DeepEqual(obj1, obj2)
+}
+
+// normalize decodes the payload as what json would have decoded, so that numbers are all json.Number
+func (store *entityStore) normalize(codecName string, payload []byte) (interface{}, error) {
+	decoded, err := store.decodeGeneric(codecName, payload)
+	if err != nil || codecName == "json" || codecName == "" {
+		return decoded, err
+	}
+	asJson, err := store.cfg.jsonApi.Marshal(decoded)
+	if err != nil {
+		return nil, err
+	}
+	return decodeJsonNumber(asJson)
+}
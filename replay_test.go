@@ -0,0 +1,115 @@
+package quokka
+
+import (
+	"testing"
+	"github.com/json-iterator/go/require"
+)
+
+func defineDepositAccount(multiplier int64) *entityStore {
+	return Config{}.Froze().StoreOf("account").
+		StateType(func() interface{} {
+		return &Account{}
+	}).
+		Command("create", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return ResponseMessage{Errno: 0}, &Account{}, nil
+		}).
+		Command("deposit",
+		func() interface{} {
+			var val int64
+			return &val
+		},
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			amount := *(request.(*int64))
+			account := state.(*Account)
+			return ResponseMessage{Errno: 0}, &Account{
+				UsableBalance: account.UsableBalance + amount*multiplier,
+			}, nil
+		})
+}
+
+func Test_replay(t *testing.T) {
+	should := require.New(t)
+	buggyAccounts := defineDepositAccount(2)
+	backend := NewMemoryBackend()
+	worker := buggyAccounts.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "deposit", []byte("100"))
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-002", "deposit", []byte("50"))
+	should.Nil(err)
+
+	report, err := buggyAccounts.ReplayFromBackend(backend, accountId, 0)
+	should.Nil(err)
+	should.Equal(int64(3), report.ReplayedVersion)
+	should.Equal(0, len(report.Divergences))
+
+	fixedAccounts := defineDepositAccount(1)
+	report, err = fixedAccounts.ReplayFromBackend(backend, accountId, 2)
+	should.Nil(err)
+	should.Equal(int64(2), report.ReplayedVersion)
+	should.Equal(1, len(report.Divergences))
+	should.Equal(int64(2), report.Divergences[0].Version)
+	should.Equal(`{"UsableBalance":200,"FrozenBalance":0}`, string(report.Divergences[0].StoredState))
+	should.Equal(`{"UsableBalance":100,"FrozenBalance":0}`, string(report.Divergences[0].ReplayedState))
+	should.Equal(`{"UsableBalance":100,"FrozenBalance":0}`, string(report.StateJson))
+}
+
+func Test_replay_deleted_and_created_again(t *testing.T) {
+	should := require.New(t)
+	middlewareCalls := 0
+	accounts := defineDepositAccount(1).
+		CommandWithMode("close", Delete, nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return ResponseMessage{Errno: 0}, nil, nil
+		}).
+		CommandWithMode("open", CreateIfAbsent,
+		func() interface{} {
+			var val int64
+			return &val
+		},
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account, _ := state.(*Account)
+			if account == nil {
+				account = &Account{}
+			}
+			return ResponseMessage{Errno: 0}, &Account{
+				UsableBalance: account.UsableBalance + *(request.(*int64)),
+			}, nil
+		}).
+		Use(func(ctx *CommandContext, handleCommand HandleCommand) HandleCommand {
+		middlewareCalls++
+		return handleCommand
+	})
+	backend := NewMemoryBackend()
+	worker := accounts.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "deposit", []byte("100"))
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "close", "close", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "open", "open", []byte("50"))
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "close-again", "close", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "create-again", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-002", "deposit", []byte("20"))
+	should.Nil(err)
+	should.Equal(7, middlewareCalls)
+
+	report, err := accounts.ReplayFromBackend(backend, accountId, 0)
+	should.Nil(err)
+	should.Equal(int64(7), report.ReplayedVersion)
+	should.Equal(0, len(report.Divergences))
+	should.Equal(`{"UsableBalance":20,"FrozenBalance":0}`, string(report.StateJson))
+	should.Equal(7, middlewareCalls)
+	report, err = accounts.ReplayFromBackend(backend, accountId, 4)
+	should.Nil(err)
+	should.Equal(0, len(report.Divergences))
+	should.Equal(`{"UsableBalance":50,"FrozenBalance":0}`, string(report.StateJson))
+}
@@ -0,0 +1,398 @@
+package quokka
+
+import (
+	"fmt"
+	"github.com/v2pro/plz"
+	"github.com/v2pro/plz/sql"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var firedCommands = plz.Logger("metric", "scheduler")
+
+// SchedulerSink is the outbox sink name of Scheduler, schedules in Result are delivered to it
+const SchedulerSink = "quokka.scheduler"
+
+// ScheduledCommand is fired into the worker of the entity when due.
+// ScheduleId should be unique in the schedule table, it is also used to derive the command id,
+// so firing the same schedule more than once applies only once.
+type ScheduledCommand struct {
+	ScheduleId  string
+	EntityName  string
+	EntityId    string
+	CommandName string
+	// Request is encoded by the codec of the target store
+	Request []byte
+	DueAt   time.Time
+}
+
+// CommandId is derived from the schedule id
+func (cmd *ScheduledCommand) CommandId() string {
+	return "schedule-" + cmd.ScheduleId
+}
+
+// scheduleMessage is the outbox payload of Result.Schedule and Result.Unschedule
+type scheduleMessage struct {
+	Schedule   *ScheduledCommand
+	Unschedule string
+}
+
+// ScheduleBackend persists the schedules not fired yet
+type ScheduleBackend interface {
+	// Save keeps the existing one if the schedule id has been saved
+	Save(cmd *ScheduledCommand) error
+	// Remove does nothing if the schedule does not exist
+	Remove(scheduleId string) error
+	// Postpone changes the due time, it does nothing if the schedule does not exist
+	Postpone(scheduleId string, dueAt time.Time) error
+	// Due returns at most limit schedules due not after the time, in due time order
+	Due(now time.Time, limit int) ([]*ScheduledCommand, error)
+}
+
+// Scheduler fires the due commands into the workers started by the same config,
+// handler schedules or cancels commands by Result, which is delivered by OutboxDispatcher with the SchedulerSink
+type Scheduler struct {
+	cfg           *frozenConfig
+	backend       ScheduleBackend
+	deadLetters   DeadLetterBackend
+	retryInterval time.Duration
+}
+
+func NewScheduler(backend ScheduleBackend) *Scheduler {
+	return ConfigDefault.NewScheduler(backend)
+}
+
+func (cfg *frozenConfig) NewScheduler(backend ScheduleBackend) *Scheduler {
+	return &Scheduler{cfg: cfg, backend: backend, retryInterval: 10 * time.Second}
+}
+
+// RetryInterval postpones the schedule failed to fire by the interval, 10 seconds by default.
+// The failed schedule then queues behind the ones already due, instead of being fired first again and again.
+func (scheduler *Scheduler) RetryInterval(interval time.Duration) *Scheduler {
+	scheduler.retryInterval = interval
+	return scheduler
+}
+
+// DeadLetter records the rejected scheduled commands, the backend is registered to the config,
+// so the letters can be replayed by the admin api
+func (scheduler *Scheduler) DeadLetter(backend DeadLetterBackend) *Scheduler {
+	scheduler.cfg.registerDeadLetters(backend)
+	scheduler.deadLetters = backend
+	return scheduler
+}
+
+func (scheduler *Scheduler) Schedule(cmd *ScheduledCommand) error {
+	return scheduler.backend.Save(cmd)
+}
+
+// Cancel removes the schedule, it has no effect if the command has been fired
+func (scheduler *Scheduler) Cancel(scheduleId string) error {
+	return scheduler.backend.Remove(scheduleId)
+}
+
+// Deliver makes Scheduler the sink of outbox, register it by the name SchedulerSink
+func (scheduler *Scheduler) Deliver(envelope *OutboxEnvelope) error {
+	message := scheduleMessage{}
+	err := scheduler.cfg.jsonApi.Unmarshal(envelope.Payload, &message)
+	if err != nil {
+		return err
+	}
+	if message.Schedule != nil {
+		return scheduler.Schedule(message.Schedule)
+	}
+	return scheduler.Cancel(message.Unschedule)
+}
+
+// Start fires the due commands every second
+func (scheduler *Scheduler) Start() {
+	go func() {
+		for {
+			fired, err := scheduler.FireDue(time.Now(), 1000)
+			if err != nil {
+				firedCommands.Error("failed to fire scheduled command", "error", err)
+			}
+			if fired < 1000 || err != nil {
+				time.Sleep(time.Second)
+			}
+		}
+	}()
+}
+
+// ScheduleFireError collects the schedules failed to fire, keyed by schedule id
+type ScheduleFireError struct {
+	Failed map[string]error
+}
+
+func (err *ScheduleFireError) Error() string {
+	scheduleIds := make([]string, 0, len(err.Failed))
+	for scheduleId := range err.Failed {
+		scheduleIds = append(scheduleIds, scheduleId)
+	}
+	sort.Strings(scheduleIds)
+	descriptions := make([]string, 0, len(scheduleIds))
+	for _, scheduleId := range scheduleIds {
+		descriptions = append(descriptions, scheduleId+": "+err.Failed[scheduleId].Error())
+	}
+	return "failed to fire schedules: " + strings.Join(descriptions, "; ")
+}
+
+// FireDue handles the commands due not after now, the schedule is removed after the command handled.
+// Failed schedule does not stop the others. Schedule failed with transient error, or of which worker not started,
+// is postponed by the retry interval after now to be fired again,
+// schedule rejected by the target is removed and recorded by the dead letter backend if set.
+// The failures are returned as ScheduleFireError.
+func (scheduler *Scheduler) FireDue(now time.Time, limit int) (int, error) {
+	due, err := scheduler.backend.Due(now, limit)
+	if err != nil {
+		return 0, err
+	}
+	fired := 0
+	fireErr := &ScheduleFireError{Failed: map[string]error{}}
+	for _, cmd := range due {
+		err = scheduler.fire(cmd, now)
+		if err != nil {
+			fireErr.Failed[cmd.ScheduleId] = err
+			continue
+		}
+		fired++
+	}
+	if len(fireErr.Failed) > 0 {
+		return fired, fireErr
+	}
+	return fired, nil
+}
+
+func (scheduler *Scheduler) fire(cmd *ScheduledCommand, now time.Time) error {
+	target := scheduler.cfg.workerOf(cmd.EntityName)
+	if target == nil {
+		scheduler.postpone(cmd, now)
+		return fmt.Errorf("no worker started for entity: %v", cmd.EntityName)
+	}
+	_, err := target.Handle(cmd.EntityId, cmd.CommandId(), cmd.CommandName, cmd.Request)
+	if err != nil && IsTransient(err) {
+		scheduler.postpone(cmd, now)
+		return err
+	}
+	if err != nil {
+		scheduler.reject(cmd, err)
+	}
+	removeErr := scheduler.backend.Remove(cmd.ScheduleId)
+	if removeErr != nil {
+		return removeErr
+	}
+	return err
+}
+
+// postpone keeps the schedule to be fired again, the error of postponing is only logged,
+// the schedule is fired again without delay in that case
+func (scheduler *Scheduler) postpone(cmd *ScheduledCommand, now time.Time) {
+	err := scheduler.backend.Postpone(cmd.ScheduleId, now.Add(scheduler.retryInterval))
+	if err != nil {
+		errorLogger.Error("failed to postpone schedule",
+			"schedule_id", cmd.ScheduleId,
+			"error", err)
+	}
+}
+
+// reject records the scheduled command not to be fired again, the error of recording is only logged
+func (scheduler *Scheduler) reject(cmd *ScheduledCommand, err error) {
+	if scheduler.deadLetters == nil {
+		return
+	}
+	now := time.Now()
+	recordErr := scheduler.deadLetters.Record(&DeadLetter{
+		LetterId:        deadLetterIdOf(cmd.EntityName, cmd.EntityId, cmd.CommandId()),
+		EntityName:      cmd.EntityName,
+		EntityId:        cmd.EntityId,
+		CommandId:       cmd.CommandId(),
+		CommandName:     cmd.CommandName,
+		Request:         cmd.Request,
+		ExpectedVersion: AnyVersion,
+		Error:           err.Error(),
+		Attempts:        1,
+		FirstFailedAt:   now,
+		LastFailedAt:    now,
+	})
+	if recordErr != nil {
+		errorLogger.Error("failed to record dead letter",
+			"schedule_id", cmd.ScheduleId,
+			"error", recordErr)
+	}
+}
+
+type memoryScheduleBackend struct {
+	mutex     *sync.Mutex
+	schedules map[string]*ScheduledCommand
+}
+
+// NewMemoryScheduleBackend keeps schedules in memory, for unit testing
+func NewMemoryScheduleBackend() ScheduleBackend {
+	return &memoryScheduleBackend{
+		mutex:     &sync.Mutex{},
+		schedules: map[string]*ScheduledCommand{},
+	}
+}
+
+func (backend *memoryScheduleBackend) Save(cmd *ScheduledCommand) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if backend.schedules[cmd.ScheduleId] == nil {
+		copied := *cmd
+		backend.schedules[cmd.ScheduleId] = &copied
+	}
+	return nil
+}
+
+func (backend *memoryScheduleBackend) Remove(scheduleId string) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	delete(backend.schedules, scheduleId)
+	return nil
+}
+
+func (backend *memoryScheduleBackend) Postpone(scheduleId string, dueAt time.Time) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	if cmd := backend.schedules[scheduleId]; cmd != nil {
+		// copy on write, the schedule returned by Due is not changed
+		copied := *cmd
+		copied.DueAt = dueAt
+		backend.schedules[scheduleId] = &copied
+	}
+	return nil
+}
+
+func (backend *memoryScheduleBackend) Due(now time.Time, limit int) ([]*ScheduledCommand, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+	due := []*ScheduledCommand{}
+	for _, cmd := range backend.schedules {
+		if !cmd.DueAt.After(now) {
+			due = append(due, cmd)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].DueAt.Before(due[j].DueAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+type sqlScheduleBackend struct {
+	cfg         *frozenConfig
+	tableName   string
+	conn        sql.Conn
+	insertSql   sql.Translated
+	getSql      sql.Translated
+	removeSql   sql.Translated
+	postponeSql sql.Translated
+	dueSql      sql.Translated
+}
+
+// SqlScheduleBackend stores schedules in the table, due time is stored as unix milliseconds
+func SqlScheduleBackend(conn sql.Conn, tableName string) *sqlScheduleBackend {
+	return ConfigDefault.SqlScheduleBackend(conn, tableName)
+}
+
+func (cfg *frozenConfig) SqlScheduleBackend(conn sql.Conn, tableName string) *sqlScheduleBackend {
+	return &sqlScheduleBackend{
+		cfg:       cfg,
+		tableName: tableName,
+		conn:      conn,
+		insertSql: sql.Translate("INSERT INTO "+tableName+" :INSERT_COLUMNS",
+			"schedule_id", "entity_name", "entity_id", "command_name", "request", "due_at"),
+		getSql:      sql.Translate("SELECT * FROM " + tableName + " WHERE schedule_id=:schedule_id"),
+		removeSql:   sql.Translate("DELETE FROM " + tableName + " WHERE schedule_id=:schedule_id"),
+		postponeSql: sql.Translate("UPDATE " + tableName + " SET due_at=:due_at WHERE schedule_id=:schedule_id"),
+		dueSql:      sql.Translate("SELECT * FROM " + tableName + " WHERE due_at<=:due_at ORDER BY due_at LIMIT :limit"),
+	}
+}
+
+// CreateTable creates the schedule table if not exists, request is binary if the store codec is not json
+func (backend *sqlScheduleBackend) CreateTable() error {
+	stmt := backend.conn.TranslateStatement(backend.cfg.dialect.CreateScheduleTableSql(
+		backend.tableName, backend.cfg.storeCodec != "json"))
+	defer stmt.Close()
+	_, err := stmt.Exec()
+	return err
+}
+
+func (backend *sqlScheduleBackend) Save(cmd *ScheduledCommand) error {
+	stmt := backend.conn.Statement(backend.insertSql)
+	defer stmt.Close()
+	_, insertErr := stmt.Exec(
+		"schedule_id", cmd.ScheduleId,
+		"entity_name", cmd.EntityName,
+		"entity_id", cmd.EntityId,
+		"command_name", cmd.CommandName,
+		"request", cmd.Request,
+		"due_at", toUnixMillis(cmd.DueAt))
+	if insertErr == nil {
+		return nil
+	}
+	// the primary key violation is not translated by dialect, check if it is saved before
+	saved, err := backend.query(backend.getSql, "schedule_id", cmd.ScheduleId)
+	if err != nil || len(saved) == 0 {
+		return insertErr
+	}
+	return nil
+}
+
+func (backend *sqlScheduleBackend) Remove(scheduleId string) error {
+	stmt := backend.conn.Statement(backend.removeSql)
+	defer stmt.Close()
+	_, err := stmt.Exec("schedule_id", scheduleId)
+	return err
+}
+
+func (backend *sqlScheduleBackend) Postpone(scheduleId string, dueAt time.Time) error {
+	stmt := backend.conn.Statement(backend.postponeSql)
+	defer stmt.Close()
+	_, err := stmt.Exec("due_at", toUnixMillis(dueAt), "schedule_id", scheduleId)
+	return err
+}
+
+func (backend *sqlScheduleBackend) Due(now time.Time, limit int) ([]*ScheduledCommand, error) {
+	return backend.query(backend.dueSql, "due_at", toUnixMillis(now), "limit", limit)
+}
+
+func (backend *sqlScheduleBackend) query(translated sql.Translated, kv ...interface{}) ([]*ScheduledCommand, error) {
+	stmt := backend.conn.Statement(translated)
+	defer stmt.Close()
+	rows, err := stmt.Query(kv...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	schedules := []*ScheduledCommand{}
+	for {
+		err = rows.Next()
+		if err == io.EOF {
+			return schedules, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, &ScheduledCommand{
+			ScheduleId:  rows.GetString(rows.C("schedule_id")),
+			EntityName:  rows.GetString(rows.C("entity_name")),
+			EntityId:    rows.GetString(rows.C("entity_id")),
+			CommandName: rows.GetString(rows.C("command_name")),
+			Request:     rows.GetByteArray(rows.C("request")),
+			DueAt:       fromUnixMillis(rows.GetInt64(rows.C("due_at"))),
+		})
+	}
+}
+
+func toUnixMillis(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+func fromUnixMillis(millis int64) time.Time {
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
@@ -0,0 +1,200 @@
+package quokka
+
+import (
+	"testing"
+	"time"
+	"github.com/json-iterator/go/require"
+)
+
+// the request of freeze and confirm is the freeze id, the account id is fixed in the test
+func defineFreezingAccount(cfg *frozenConfig, dueAt time.Time) *entityStore {
+	freezeIdOf := func() interface{} {
+		var freezeId string
+		return &freezeId
+	}
+	return defineAccount(cfg.StoreOf("account")).
+		Command("freeze", freezeIdOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account := state.(*Account)
+			return &Result{
+				Response: ResponseMessage{},
+				Schedule: []ScheduledCommand{{
+					ScheduleId:  "release-" + *(request.(*string)),
+					EntityName:  "account",
+					EntityId:    "account-001",
+					CommandName: "release",
+					DueAt:       dueAt,
+				}},
+			}, &Account{UsableBalance: account.UsableBalance - 10, FrozenBalance: account.FrozenBalance + 10}, nil
+		}).
+		Command("release", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account := state.(*Account)
+			return ResponseMessage{}, &Account{UsableBalance: account.UsableBalance + account.FrozenBalance}, nil
+		}).
+		Command("confirm", freezeIdOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account := state.(*Account)
+			return &Result{
+				Response:   ResponseMessage{},
+				Unschedule: []string{"release-" + *(request.(*string))},
+			}, &Account{UsableBalance: account.UsableBalance}, nil
+		})
+}
+
+func Test_scheduled_command(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	now := time.Now()
+	store := defineFreezingAccount(cfg, now.Add(30*time.Minute))
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	scheduler := cfg.NewScheduler(NewMemoryScheduleBackend())
+	dispatcher := NewOutboxDispatcher(worker, cfg.OutboxStore("account_outbox").StartBackendWorker(NewMemoryBackend())).
+		Sink(SchedulerSink, scheduler)
+	_, err := worker.Handle("account-001", "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle("account-001", "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	_, err = worker.Handle("account-001", "freeze-001", "freeze", []byte(`"f1"`))
+	should.Nil(err)
+	_, err = dispatcher.DispatchBatch(100)
+	should.Nil(err)
+	fired, err := scheduler.FireDue(now, 100)
+	should.Nil(err)
+	should.Equal(0, fired)
+	fired, err = scheduler.FireDue(now.Add(31*time.Minute), 100)
+	should.Nil(err)
+	should.Equal(1, fired)
+	account, err := store.GetFromBackend(backend, "account-001")
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 100}, *account.State.(*Account))
+	// confirmed before due, the release is cancelled
+	_, err = worker.Handle("account-001", "freeze-002", "freeze", []byte(`"f2"`))
+	should.Nil(err)
+	_, err = worker.Handle("account-001", "confirm-002", "confirm", []byte(`"f2"`))
+	should.Nil(err)
+	_, err = dispatcher.DispatchBatch(100)
+	should.Nil(err)
+	fired, err = scheduler.FireDue(now.Add(31*time.Minute), 100)
+	should.Nil(err)
+	should.Equal(0, fired)
+	account, err = store.GetFromBackend(backend, "account-001")
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 90}, *account.State.(*Account))
+}
+
+func Test_rejected_schedule_does_not_block_others(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	now := time.Now()
+	store := defineFreezingAccount(cfg, now)
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	deadLetters := NewMemoryDeadLetterBackend()
+	scheduleBackend := NewMemoryScheduleBackend()
+	scheduler := cfg.NewScheduler(scheduleBackend).DeadLetter(deadLetters)
+	_, err := worker.Handle("account-001", "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle("account-001", "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.Nil(scheduler.Schedule(&ScheduledCommand{
+		ScheduleId:  "poison",
+		EntityName:  "account",
+		EntityId:    "account-001",
+		CommandName: "no-such-command",
+		DueAt:       now.Add(-time.Minute),
+	}))
+	should.Nil(scheduler.Schedule(&ScheduledCommand{
+		ScheduleId:  "release",
+		EntityName:  "account",
+		EntityId:    "account-001",
+		CommandName: "release",
+		DueAt:       now,
+	}))
+	fired, err := scheduler.FireDue(now, 100)
+	should.NotNil(err)
+	should.Contains(err.(*ScheduleFireError).Failed, "poison")
+	should.Equal(1, fired)
+	// the poison schedule is removed and recorded as dead letter
+	due, err := scheduleBackend.Due(now, 100)
+	should.Nil(err)
+	should.Equal(0, len(due))
+	letters, err := deadLetters.List("account", 100)
+	should.Nil(err)
+	should.Equal(1, len(letters))
+	should.Equal("schedule-poison", letters[0].CommandId)
+	letters, err = cfg.listDeadLetters("account", 100)
+	should.Nil(err)
+	should.Equal(1, len(letters))
+}
+
+func Test_failed_schedule_is_postponed(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	now := time.Now()
+	worker := defineFreezingAccount(cfg, now).StartBackendWorker(NewMemoryBackend())
+	scheduleBackend := NewMemoryScheduleBackend()
+	scheduler := cfg.NewScheduler(scheduleBackend).RetryInterval(time.Minute)
+	_, err := worker.Handle("account-001", "create", "create", nil)
+	should.Nil(err)
+	should.Nil(scheduler.Schedule(&ScheduledCommand{
+		ScheduleId:  "not-started",
+		EntityName:  "order",
+		EntityId:    "order-001",
+		CommandName: "cancel",
+		DueAt:       now.Add(-time.Minute),
+	}))
+	should.Nil(scheduler.Schedule(&ScheduledCommand{
+		ScheduleId:  "release",
+		EntityName:  "account",
+		EntityId:    "account-001",
+		CommandName: "release",
+		DueAt:       now,
+	}))
+	fired, err := scheduler.FireDue(now, 1)
+	should.NotNil(err)
+	should.Contains(err.(*ScheduleFireError).Failed, "not-started")
+	should.Equal(0, fired)
+	// the failed schedule no longer blocks the head of the due schedules
+	fired, err = scheduler.FireDue(now, 1)
+	should.Nil(err)
+	should.Equal(1, fired)
+	due, err := scheduleBackend.Due(now, 100)
+	should.Nil(err)
+	should.Equal(0, len(due))
+	due, err = scheduleBackend.Due(now.Add(time.Minute), 100)
+	should.Nil(err)
+	should.Equal(1, len(due))
+	should.Equal("not-started", due[0].ScheduleId)
+}
+
+func Test_sqlite_schedule_backend(t *testing.T) {
+	should := require.New(t)
+	conn, cleanup := openSqlite(t)
+	defer cleanup()
+	backend := Config{Dialect: DialectSQLite}.Froze().SqlScheduleBackend(conn, "schedule")
+	should.Nil(backend.CreateTable())
+	now := time.Now()
+	cmd := &ScheduledCommand{ScheduleId: "s1", EntityName: "account", EntityId: "a1",
+		CommandName: "release", Request: []byte("10"), DueAt: now}
+	should.Nil(backend.Save(cmd))
+	should.Nil(backend.Save(cmd))
+	should.Nil(backend.Save(&ScheduledCommand{ScheduleId: "s2", EntityName: "account", EntityId: "a2",
+		CommandName: "release", DueAt: now.Add(time.Hour)}))
+	due, err := backend.Due(now, 10)
+	should.Nil(err)
+	should.Equal(1, len(due))
+	should.Equal("s1", due[0].ScheduleId)
+	should.Equal("10", string(due[0].Request))
+	should.Equal(toUnixMillis(now), toUnixMillis(due[0].DueAt))
+	should.Nil(backend.Postpone("s1", now.Add(time.Minute)))
+	due, err = backend.Due(now, 10)
+	should.Nil(err)
+	should.Equal(0, len(due))
+	should.Nil(backend.Remove("s1"))
+	due, err = backend.Due(now.Add(time.Hour), 10)
+	should.Nil(err)
+	should.Equal(1, len(due))
+	should.Equal("s2", due[0].ScheduleId)
+}
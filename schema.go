@@ -0,0 +1,86 @@
+package quokka
+
+import (
+	"fmt"
+	"strings"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// ValidationError is replied when request or new state does not match the json schema,
+// http responds it as json body
+type ValidationError struct {
+	// Target is either "request" or "state"
+	Target     string      `json:"target"`
+	Violations []Violation `json:"violations"`
+}
+
+type Violation struct {
+	Field       string `json:"field"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+func (err *ValidationError) Error() string {
+	descriptions := make([]string, 0, len(err.Violations))
+	for _, violation := range err.Violations {
+		descriptions = append(descriptions, violation.Field+": "+violation.Description)
+	}
+	return fmt.Sprintf("invalid %s: %s", err.Target, strings.Join(descriptions, "; "))
+}
+
+// RequestSchema validates the raw request json of the command before the handler runs
+func (store *entityStore) RequestSchema(commandName string, schema []byte) *entityStore {
+	store.requestSchemas[commandName] = mustLoadSchema(schema)
+	return store
+}
+
+// StateSchema validates the new state json before it is persisted
+func (store *entityStore) StateSchema(schema []byte) *entityStore {
+	store.stateSchema = mustLoadSchema(schema)
+	return store
+}
+
+func mustLoadSchema(schema []byte) *gojsonschema.Schema {
+	loaded, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schema))
+	if err != nil {
+		panic(fmt.Errorf("invalid json schema: %v", err))
+	}
+	return loaded
+}
+
+// validate converts the payload of store codec to json before validation
+func (store *entityStore) validate(schema *gojsonschema.Schema, target string, doc []byte) error {
+	if schema == nil {
+		return nil
+	}
+	doc, err := store.toJson(doc)
+	if err != nil {
+		return err
+	}
+	return validateJson(schema, target, doc)
+}
+
+func validateJson(schema *gojsonschema.Schema, target string, doc []byte) error {
+	if schema == nil {
+		return nil
+	}
+	if len(doc) == 0 {
+		doc = []byte("null")
+	}
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(doc))
+	if err != nil {
+		return err
+	}
+	if result.Valid() {
+		return nil
+	}
+	validationError := &ValidationError{Target: target}
+	for _, resultError := range result.Errors() {
+		validationError.Violations = append(validationError.Violations, Violation{
+			Field:       resultError.Field(),
+			Type:        resultError.Type(),
+			Description: resultError.Description(),
+		})
+	}
+	return validationError
+}
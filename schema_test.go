@@ -0,0 +1,52 @@
+package quokka
+
+import (
+	"testing"
+	"net/http"
+	"net/http/httptest"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+func Test_request_schema(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).
+		RequestSchema("transfer1pc", []byte(`{"type": "integer", "minimum": -10000}`))
+	worker := store.StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte(`"100"`))
+	validationError := err.(*ValidationError)
+	should.Equal("request", validationError.Target)
+	should.Equal(1, len(validationError.Violations))
+	should.Equal("invalid_type", validationError.Violations[0].Type)
+	recorder := httptest.NewRecorder()
+	writeHttpError(recorder, err)
+	should.Equal(http.StatusBadRequest, recorder.Code)
+	should.Equal("application/json", recorder.Header().Get("Content-Type"))
+	should.Equal("invalid_type", jsoniter.Get(recorder.Body.Bytes(), "violations", 0, "type").ToString())
+	_, err = worker.Handle(accountId, "xxx-002", "transfer1pc", []byte(`100`))
+	should.Nil(err)
+}
+
+func Test_state_schema(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).
+		StateSchema([]byte(`{
+			"type": "object",
+			"properties": {"UsableBalance": {"type": "integer", "maximum": 1000}}
+		}`))
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte(`2000`))
+	validationError := err.(*ValidationError)
+	should.Equal("state", validationError.Target)
+	should.Equal("UsableBalance", validationError.Violations[0].Field)
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(0), account.State.(*Account).UsableBalance)
+}
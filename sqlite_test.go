@@ -0,0 +1,136 @@
+package quokka
+
+import (
+	"testing"
+	"os"
+	"path/filepath"
+	"io/ioutil"
+	"github.com/mattn/go-sqlite3"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+	"github.com/v2pro/plz"
+	"github.com/v2pro/plz/sql"
+	"strconv"
+)
+
+var sqliteAccounts = defineAccount(Config{Dialect: DialectSQLite}.Froze().StoreOf("account"))
+
+func openSqlite(t *testing.T) (sql.Conn, func()) {
+	should := require.New(t)
+	dir, err := ioutil.TempDir("", "quokka")
+	should.Nil(err)
+	drv := &sqlite3.SQLiteDriver{}
+	conn, err := plz.OpenSqlConn(drv, filepath.Join(dir, "quokka.db"))
+	should.Nil(err)
+	should.Nil(sqliteAccounts.CreateTable(conn))
+	return conn, func() {
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func Test_sqlite_create(t *testing.T) {
+	should := require.New(t)
+	conn, cleanup := openSqlite(t)
+	defer cleanup()
+	accountId := NewID().String()
+	worker := sqliteAccounts.StartWorker(conn)
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	account, err := sqliteAccounts.Get(conn, accountId)
+	should.Nil(err)
+	should.Equal(accountId, account.EntityId)
+	should.Equal(int64(1), account.Version)
+}
+
+func Test_sqlite_create_should_be_idempotent(t *testing.T) {
+	should := require.New(t)
+	conn, cleanup := openSqlite(t)
+	defer cleanup()
+	accountId := NewID().String()
+	worker := sqliteAccounts.StartWorker(conn)
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+}
+
+func Test_sqlite_update_should_be_idempotent(t *testing.T) {
+	should := require.New(t)
+	conn, cleanup := openSqlite(t)
+	defer cleanup()
+	accountId := NewID().String()
+	worker := sqliteAccounts.StartWorker(conn)
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	response, err := worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.Equal(0, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	response, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.Equal(0, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	account, err := sqliteAccounts.Get(conn, accountId)
+	should.Nil(err)
+	should.Equal(int64(100), account.State.(*Account).UsableBalance)
+}
+
+func Test_sqlite_batch(t *testing.T) {
+	should := require.New(t)
+	conn, cleanup := openSqlite(t)
+	defer cleanup()
+	accountId := NewID().String()
+	worker := sqliteAccounts.StartWorker(conn)
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	responsePromises := []chan interface{}{}
+	for i := 0; i < 1000; i++ {
+		responsePromise := worker.HandleAsync(accountId, strconv.FormatInt(int64(i), 10), "transfer1pc", []byte("1"))
+		responsePromises = append(responsePromises, responsePromise)
+	}
+	for _, responsePromise := range responsePromises {
+		_, ok := (<-responsePromise).([]byte)
+		should.True(ok)
+	}
+	account, err := sqliteAccounts.Get(conn, accountId)
+	should.Nil(err)
+	should.Equal(int64(1000), account.State.(*Account).UsableBalance)
+}
+
+func Test_sqlite_upgrade_table(t *testing.T) {
+	should := require.New(t)
+	dir, err := ioutil.TempDir("", "quokka")
+	should.Nil(err)
+	defer os.RemoveAll(dir)
+	conn, err := plz.OpenSqlConn(&sqlite3.SQLiteDriver{}, filepath.Join(dir, "quokka.db"))
+	should.Nil(err)
+	defer conn.Close()
+	// the table created by the first release
+	stmt := conn.TranslateStatement(`CREATE TABLE account (
+  event_id     INTEGER      NOT NULL       PRIMARY KEY AUTOINCREMENT,
+  entity_id    CHAR(20)     NOT NULL,
+  version      BIGINT       NOT NULL,
+  command_id   VARCHAR(256) NOT NULL,
+  command_name VARCHAR(256) NOT NULL,
+  request      TEXT         NULL,
+  response     TEXT         NOT NULL,
+  state        TEXT         NOT NULL,
+  committed_at DATETIME     NOT NULL       DEFAULT CURRENT_TIMESTAMP,
+  CONSTRAINT unique_version UNIQUE (entity_id, version),
+  CONSTRAINT unique_command UNIQUE (entity_id, command_id)
+)`)
+	_, err = stmt.Exec()
+	stmt.Close()
+	should.Nil(err)
+	should.Nil(sqliteAccounts.UpgradeTable(conn))
+	// upgrade again is no-op
+	should.Nil(sqliteAccounts.UpgradeTable(conn))
+	accountId := NewID().String()
+	worker := sqliteAccounts.StartWorker(conn)
+	_, err = worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	account, err := sqliteAccounts.Get(conn, accountId)
+	should.Nil(err)
+	should.Equal(int64(100), account.State.(*Account).UsableBalance)
+}
@@ -3,10 +3,12 @@ package quokka
 import (
 	"time"
 	"fmt"
-	"database/sql/driver"
+	"errors"
 	"github.com/v2pro/plz/sql"
 	"github.com/v2pro/plz"
 	"github.com/v2pro/plz/log"
+	"sync/atomic"
+	"github.com/xeipuuv/gojsonschema"
 	_ "github.com/v2pro/quokka/bootstrap"
 )
 
@@ -23,18 +25,50 @@ type entityStore struct {
 	insertSql           sql.Translated
 	getLatestStateSql   sql.Translated
 	getEventSql         sql.Translated
+	getHistorySql       sql.Translated
+	scanSql             sql.Translated
+	deleteHistorySql    sql.Translated
 	commandHandlers     map[string]HandleCommand
 	commandRequestTypes map[string]func() interface{}
+	commandModes        map[string]CommandMode
 	stateType           func() interface{}
+	codecName           string
+	codec               Codec
+	middlewares         []Middleware
+	requestSchemas      map[string]*gojsonschema.Schema
+	stateSchema         *gojsonschema.Schema
+	stateVersion        int
+	upcasters           map[int]Upcaster
+	snapshotEvery       int
+	deadLetters         DeadLetterBackend
+	deadLetterWhen      func(err error) bool
+	timeBudget          time.Duration
+	commandTimeBudgets  map[string]time.Duration
+	failOverBudget      bool
+	maxOverBudget       int64
+	// overBudget counts the handlers still running after their budget exceeded
+	overBudget          int64
+	queueCapacity       int
+	maxInFlight         int
+	prefixRateLimits    map[string]rateLimit
+	tenantRateLimit     *tenantRateLimit
+	commandRateLimits   map[string]rateLimit
 }
 
+// AnyVersion skips the expected version check
+const AnyVersion int64 = -1
+
 type command struct {
 	entityId        string
 	commandId       string
 	commandName     string
 	request         []byte
+	expectedVersion int64
+	recreating      bool
 	replied         bool
 	responsePromise chan interface{}
+	// release is set if the command is counted in flight
+	release         func()
 }
 
 func (cmd *command) reply(response interface{}) {
@@ -43,6 +77,9 @@ func (cmd *command) reply(response interface{}) {
 		return
 	}
 	cmd.replied = true
+	if cmd.release != nil {
+		cmd.release()
+	}
 	cmd.responsePromise <- response
 }
 
@@ -54,9 +91,27 @@ func (cmd *command) delayReply(response interface{}) func() {
 
 type worker struct {
 	store       *entityStore
-	conn        sql.Conn
+	backend     Backend
 	commandQ    chan *command
 	entityCache map[string]*Entity
+	// pending is the entities with event not committed yet in the current batch
+	pending     map[string]bool
+	inFlight    *inFlight
+	rateLimiter *rateLimiter
+	// deadLetterQ is set if the store records dead letters
+	deadLetterQ chan *DeadLetter
+	stats       workerStats
+}
+
+// workerStats is written by the worker goroutine and read by the admin endpoints
+type workerStats struct {
+	batchSuccess      int64
+	batchFailure      int64
+	processedCommands int64
+	lastBatchSize     int64
+	cacheSize         int64
+	handlerPanics     int64
+	durations         *commandDurations
 }
 
 func StoreOf(entityName string) *entityStore {
@@ -65,99 +120,257 @@ func StoreOf(entityName string) *entityStore {
 
 func (cfg *frozenConfig) StoreOf(entityName string) *entityStore {
 	insertSql := sql.Translate(
-		"INSERT "+entityName+" :INSERT_COLUMNS",
-		"entity_id", "version", "command_id", "command_name", "request", "response", "state")
-	getLatestStateSql := sql.Translate(
-		"SELECT * FROM " + entityName + " WHERE entity_id=:entity_id ORDER BY version DESC LIMIT 1")
-	getEventSql := sql.Translate(
-		"SELECT * FROM " + entityName + " WHERE entity_id=:entity_id AND command_id=:command_id")
+		cfg.dialect.InsertSql(entityName),
+		"entity_id", "version", "command_id", "command_name", "request", "response", "state", "state_version", "events", "tombstone", "codec", "delta_base", "outbox")
+	getLatestStateSql := sql.Translate(cfg.dialect.GetLatestStateSql(entityName))
+	getEventSql := sql.Translate(cfg.dialect.GetEventSql(entityName))
+	getHistorySql := sql.Translate(cfg.dialect.GetHistorySql(entityName))
+	scanSql := sql.Translate(cfg.dialect.ScanSql(entityName))
+	deleteHistorySql := sql.Translate(cfg.dialect.DeleteHistorySql(entityName))
 	return &entityStore{
 		cfg:                 cfg,
 		entityName:          entityName,
 		insertSql:           insertSql,
 		getLatestStateSql:   getLatestStateSql,
 		getEventSql:         getEventSql,
+		getHistorySql:       getHistorySql,
+		scanSql:             scanSql,
+		deleteHistorySql:    deleteHistorySql,
 		commandHandlers:     map[string]HandleCommand{},
 		commandRequestTypes: map[string]func() interface{}{},
+		commandModes:        map[string]CommandMode{},
+		requestSchemas:      map[string]*gojsonschema.Schema{},
+		upcasters:           map[int]Upcaster{},
+		commandTimeBudgets:  map[string]time.Duration{},
+		prefixRateLimits:    map[string]rateLimit{},
+		commandRateLimits:   map[string]rateLimit{},
+		queueCapacity:       10000,
+		maxOverBudget:       100,
+		codecName:           cfg.storeCodec,
+		codec:               cfg.codecs[cfg.storeCodec],
+	}
+}
+
+// CreateTable creates the entity table if not exists, the table layout is defined by the dialect.
+// Payload columns are binary if the store codec is not json.
+func (store *entityStore) CreateTable(conn sql.Conn) error {
+	stmt := conn.TranslateStatement(store.cfg.dialect.CreateTableSql(store.entityName, store.codecName != "json"))
+	defer stmt.Close()
+	_, err := stmt.Exec()
+	return err
+}
+
+// UpgradeTable adds the columns introduced since the table was created, existing columns are skipped.
+// It is safe to call on every start, the new columns have defaults meaning the behavior of older release.
+func (store *entityStore) UpgradeTable(conn sql.Conn) error {
+	dialect := store.cfg.dialect
+	for _, alterSql := range dialect.UpgradeTableSql(store.entityName, store.codecName != "json") {
+		stmt := conn.TranslateStatement(alterSql)
+		_, err := stmt.Exec()
+		stmt.Close()
+		err = dialect.TranslateError(err)
+		if err != nil && !errors.Is(err, ErrDuplicateColumn) {
+			return err
+		}
+	}
+	return nil
+}
+
+// MigrateToBinary converts the payload columns of the table created by json codec to binary,
+// it should be done before switching the store to binary codec, see Codec
+func (store *entityStore) MigrateToBinary(conn sql.Conn) error {
+	for _, alterSql := range store.cfg.dialect.BinaryColumnsSql(store.entityName) {
+		stmt := conn.TranslateStatement(alterSql)
+		_, err := stmt.Exec()
+		stmt.Close()
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
+// StateType is optional, without it the state will be decoded as generic map
 func (store *entityStore) StateType(stateType func() interface{}) *entityStore {
 	store.stateType = stateType
 	return store
 }
 
+// decodeState decodes state encoded by the store codec
+func (store *entityStore) decodeState(stateJson []byte) (interface{}, error) {
+	return store.decodeStateWith(store.codecName, stateJson)
+}
+
+// decodeStateWith decodes generic state by decodeGeneric, so that json number is kept as json.Number
+func (store *entityStore) decodeStateWith(codecName string, stateJson []byte) (interface{}, error) {
+	if store.stateType == nil {
+		return store.decodeGeneric(codecName, stateJson)
+	}
+	codec, err := store.cfg.codecOf(codecName)
+	if err != nil {
+		return nil, err
+	}
+	state := store.stateType()
+	err = codec.Unmarshal(stateJson, state)
+	return state, err
+}
+
+// Command registers the handler, requestType can be nil if the handler takes no request object.
+// Command named "create" is registered as MustNotExist, others are registered as MustExist.
 func (store *entityStore) Command(commandName string, requestType func() interface{}, handleCommand HandleCommand) *entityStore {
+	return store.CommandWithMode(commandName, defaultCommandMode(commandName), requestType, handleCommand)
+}
+
+func (store *entityStore) CommandWithMode(commandName string, mode CommandMode,
+	requestType func() interface{}, handleCommand HandleCommand) *entityStore {
+	store.commandModes[commandName] = mode
 	store.commandRequestTypes[commandName] = requestType
 	store.commandHandlers[commandName] = handleCommand
 	return store
 }
 
 type Entity struct {
-	EntityId  string
-	Version   int64
+	EntityId string
+	Version  int64
+	// StateJson is encoded by the store codec, which is json by default
 	StateJson []byte
 	State     interface{}
 	UpdatedAt time.Time
+	// Deleted entity is never returned by Get, it only lives in worker cache to block commands
+	Deleted bool
+	// snapshotVersion is where the delta chain of the state starts, 0 if next state must be a snapshot
+	snapshotVersion int64
 }
 
 func (store *entityStore) Get(conn sql.Conn, entityId string) (*Entity, error) {
-	stmt := conn.Statement(store.getLatestStateSql)
-	defer stmt.Close()
-	rows, err := stmt.Query("entity_id", entityId)
+	return store.GetFromBackend(store.SqlBackend(conn), entityId)
+}
+
+// GetFromBackend returns ErrNotFound if the entity has been deleted
+func (store *entityStore) GetFromBackend(backend Backend, entityId string) (*Entity, error) {
+	entity, err := store.loadLatest(backend, entityId)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	err = rows.Next()
+	if entity.Deleted {
+		return nil, fmt.Errorf("%w: entity %v has been deleted", ErrNotFound, entityId)
+	}
+	return entity, nil
+}
+
+func (store *entityStore) loadLatest(backend Backend, entityId string) (*Entity, error) {
+	event, err := backend.GetLatest(entityId)
+	if err != nil {
+		return nil, backendFailure(err)
+	}
+	// only the backend failure inside is transient, missing snapshot or corrupt patch is not
+	resolved, err := store.resolveDelta(backend, event)
 	if err != nil {
 		return nil, err
 	}
-	stateJson := []byte(rows.GetString(rows.C("state")))
-	state := store.stateType()
-	err = store.cfg.jsonApi.Unmarshal(stateJson, state)
+	entity, err := store.entityOf(resolved)
 	if err != nil {
 		return nil, err
 	}
-	entity := &Entity{
-		EntityId:  entityId,
-		Version:   rows.GetInt64(rows.C("version")),
-		StateJson: stateJson,
-		State:     state,
-		UpdatedAt: rows.GetTime(rows.C("committed_at")),
+	// the state is continued by patch only if it is exactly what stored
+	if !entity.Deleted && store.isStoreCodec(event.Codec) && event.StateVersion == store.stateVersion {
+		entity.snapshotVersion = event.DeltaBase
+		if entity.snapshotVersion == 0 {
+			entity.snapshotVersion = event.Version
+		}
 	}
 	return entity, nil
 }
 
+// entityOf expects the event with full state, see resolveDelta
+func (store *entityStore) entityOf(event *Event) (*Entity, error) {
+	if event.Tombstone {
+		return &Entity{
+			EntityId:  event.EntityId,
+			Version:   event.Version,
+			UpdatedAt: event.CommittedAt,
+			Deleted:   true,
+		}, nil
+	}
+	stateJson, err := store.upcast(event.Codec, event.StateVersion, event.State)
+	if err != nil {
+		return nil, err
+	}
+	state, err := store.decodeState(stateJson)
+	if err != nil {
+		return nil, err
+	}
+	return &Entity{
+		EntityId:  event.EntityId,
+		Version:   event.Version,
+		StateJson: stateJson,
+		State:     state,
+		UpdatedAt: event.CommittedAt,
+	}, nil
+}
+
 func (store *entityStore) StartWorker(conn sql.Conn) *worker {
+	return store.StartBackendWorker(store.SqlBackend(conn))
+}
+
+func (store *entityStore) StartBackendWorker(backend Backend) *worker {
 	worker := &worker{
 		store:       store,
 		entityCache: map[string]*Entity{},
-		conn:        conn,
-		commandQ:    make(chan *command, 10000)}
+		backend:     backend,
+		inFlight:    newInFlight(),
+		rateLimiter: newRateLimiter(),
+		stats:       workerStats{durations: newCommandDurations()},
+		commandQ:    make(chan *command, store.queueCapacity)}
+	if store.deadLetters != nil {
+		worker.deadLetterQ = make(chan *DeadLetter, deadLetterQueueCapacity)
+		go worker.recordDeadLetters()
+	}
+	store.cfg.registerWorker(worker)
 	go worker.work()
 	return worker
 }
 
 func (worker *worker) HandleAsync(entityId string, commandId string, commandName string, request []byte) chan interface{} {
+	return worker.HandleAsyncIfMatch(entityId, commandId, commandName, request, AnyVersion)
+}
+
+// HandleAsyncIfMatch applies the command only if the entity is still at expectedVersion,
+// otherwise ErrVersionConflict is replied. Version 0 means the entity should not exist yet.
+func (worker *worker) HandleAsyncIfMatch(entityId string, commandId string, commandName string, request []byte,
+	expectedVersion int64) chan interface{} {
+	command := worker.newCommand(entityId, commandId, commandName, request, expectedVersion)
+	worker.commandQ <- command
+	return command.responsePromise
+}
+
+func (worker *worker) newCommand(entityId string, commandId string, commandName string, request []byte,
+	expectedVersion int64) *command {
 	if receivedCommand.ShouldLog(log.LEVEL_DEBUG) {
 		receivedCommand.Debug("received command",
 			"command_name", commandName)
 	}
-	responsePromise := make(chan interface{}, 1)
-	command := &command{
+	return &command{
 		entityId:        entityId,
 		commandId:       commandId,
 		commandName:     commandName,
 		request:         request,
-		responsePromise: responsePromise,
+		expectedVersion: expectedVersion,
+		responsePromise: make(chan interface{}, 1),
 	}
-	worker.commandQ <- command
-	return command.responsePromise
 }
 
 func (worker *worker) Handle(entityId string, commandId string, commandName string, request []byte) ([]byte, error) {
-	responseQ := worker.HandleAsync(entityId, commandId, commandName, request)
+	return worker.HandleIfMatch(entityId, commandId, commandName, request, AnyVersion)
+}
+
+func (worker *worker) HandleIfMatch(entityId string, commandId string, commandName string, request []byte,
+	expectedVersion int64) ([]byte, error) {
+	responseQ := worker.HandleAsyncIfMatch(entityId, commandId, commandName, request, expectedVersion)
+	return awaitResponse(responseQ)
+}
+
+func awaitResponse(responseQ chan interface{}) ([]byte, error) {
 	respObj := <-responseQ
 	switch resp := respObj.(type) {
 	case []byte:
@@ -176,8 +389,11 @@ func (worker *worker) work() {
 		if len(commands) == 0 {
 			time.Sleep(time.Second)
 		} else {
+			atomic.StoreInt64(&worker.stats.lastBatchSize, int64(len(commands)))
+			atomic.AddInt64(&worker.stats.processedCommands, int64(len(commands)))
 			err := worker.batchProcess(commands)
 			if err != nil {
+				atomic.AddInt64(&worker.stats.batchFailure, 1)
 				batchProcessedCommands.Error("batch failure",
 					"count", len(commands),
 					"code", "failure",
@@ -185,18 +401,32 @@ func (worker *worker) work() {
 				for _, cmd := range commands {
 					err := worker.batchProcess([]*command{cmd})
 					if err != nil {
-						cmd.reply(err)
+						worker.replyError(cmd, err)
 					}
 				}
 			} else {
+				atomic.AddInt64(&worker.stats.batchSuccess, 1)
 				batchProcessedCommands.Info("batch success",
 					"count", len(commands),
 					"code", "success")
 			}
+			atomic.StoreInt64(&worker.stats.cacheSize, int64(len(worker.entityCache)))
 		}
 	}
 }
 
+// delayReplyCommitted replies the response of committed event, which might be written by other codec
+func (worker *worker) delayReplyCommitted(cmd *command, event *Event) func() {
+	return func() {
+		response, err := worker.store.transcode(event.Codec, event.Response)
+		if err != nil {
+			cmd.reply(err)
+			return
+		}
+		cmd.reply(response)
+	}
+}
+
 func (worker *worker) fetchCommands() []*command {
 	done := false
 	commands := []*command{}
@@ -215,29 +445,29 @@ func (worker *worker) fetchCommands() []*command {
 }
 
 func (worker *worker) batchProcess(commands []*command) (err error) {
-	store := worker.store
-	rows := []driver.Value{}
+	events := []*Event{}
 	delayedReplies := []func(){}
+	worker.pending = map[string]bool{}
 	for _, command := range commands {
-		row, response, err := worker.tryHandleOne(command)
+		event, err := worker.tryHandleOne(command)
 		if err != nil {
-			delayedReplies = append(delayedReplies, command.delayReply(err))
+			delayedReplies = append(delayedReplies, worker.delayReplyError(command, err))
+		} else if event.EventId != 0 {
+			// only event loaded from backend has event id, the command has been committed before
+			delayedReplies = append(delayedReplies, worker.delayReplyCommitted(command, event))
 		} else {
-			rows = append(rows, row)
-			delayedReplies = append(delayedReplies, command.delayReply(response))
+			worker.pending[command.entityId] = true
+			events = append(events, event)
+			delayedReplies = append(delayedReplies, command.delayReply(event.Response))
 		}
 	}
-	if len(rows) == 0 {
+	if len(events) == 0 {
 		for _, delayedReply := range delayedReplies {
 			delayedReply()
 		}
 		return nil
 	}
-	stmt := worker.conn.TranslateStatement("INSERT "+worker.store.entityName+" :BATCH_INSERT_COLUMNS",
-		sql.BatchInsertColumns(len(rows),
-			"entity_id", "version", "command_id", "command_name", "request", "response", "state"))
-	defer stmt.Close()
-	_, insertErr := stmt.Exec(rows...)
+	insertErr := worker.backend.AppendBatch(events)
 	if insertErr == nil {
 		for _, delayedReply := range delayedReplies {
 			delayedReply()
@@ -250,64 +480,230 @@ func (worker *worker) batchProcess(commands []*command) (err error) {
 	}
 	if len(commands) == 1 {
 		onlyCommand := commands[0]
-		stmt := worker.conn.Statement(store.getEventSql)
-		defer stmt.Close()
-		rows, err := stmt.Query("entity_id", onlyCommand.entityId, "command_id", onlyCommand.commandId)
-		if err != nil {
-			onlyCommand.reply(err)
+		event, err := worker.backend.GetByCommandId(onlyCommand.entityId, onlyCommand.commandId)
+		if err == nil {
+			worker.delayReplyCommitted(onlyCommand, event)()
 			return nil
 		}
-		defer rows.Close()
-		err = rows.Next()
-		if err == nil {
-			response := rows.GetByteArray(rows.C("response"))
-			onlyCommand.reply(response)
+		if err != ErrNotFound {
+			worker.replyError(onlyCommand, backendFailure(err))
 			return nil
 		}
+		if errors.Is(insertErr, ErrVersionConflict) && worker.store.commandModes[onlyCommand.commandName] == MustNotExist {
+			latest, err := worker.store.loadLatest(worker.backend, onlyCommand.entityId)
+			if err == nil && latest.Deleted && !onlyCommand.recreating {
+				// recreate the entity after the tombstone, only try once
+				onlyCommand.recreating = true
+				worker.entityCache[onlyCommand.entityId] = latest
+				return worker.batchProcess(commands)
+			}
+			return fmt.Errorf("%w: %v", ErrAlreadyExists, onlyCommand.entityId)
+		}
 	}
-	return insertErr
+	return backendFailure(insertErr)
 }
 
-func (worker *worker) tryHandleOne(command *command) (row []driver.Value, response []byte, err error) {
+func (worker *worker) handleOne(command *command) (*Event, error) {
 	store := worker.store
 	commandName := command.commandName
 	entityId := command.entityId
-	request := command.request
-	commandId := command.commandId
-	handleCommand := store.commandHandlers[commandName]
-	if handleCommand == nil {
-		return nil, nil, fmt.Errorf("no handler defined for command: %v", commandName)
-	}
-	var entity *Entity
-	if commandName == "create" {
-		entity = &Entity{
-			EntityId:  entityId,
-			Version:   0,
-			StateJson: nil,
-			State:     nil,
+	if store.commandHandlers[commandName] == nil {
+		return nil, fmt.Errorf("%w: no handler defined for command %v", ErrUnknownCommand, commandName)
+	}
+	entity, committed, err := worker.loadEntity(command)
+	if err != nil {
+		return nil, err
+	}
+	if committed != nil {
+		return committed, nil
+	}
+	if command.expectedVersion != AnyVersion && command.expectedVersion != entity.Version {
+		entity, committed, err = worker.checkExpectedVersion(command, entity)
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		entity = worker.entityCache[entityId]
-		if entity == nil {
-			entity, err = store.Get(worker.conn, entityId)
-			if err != nil {
-				return nil, nil, err
-			}
+		if committed != nil {
+			return committed, nil
+		}
+	}
+	event, newState, err := store.execute(entity, command.commandId, commandName, command.request, true,
+		func(elapsed time.Duration) {
+			worker.observeDuration(command, elapsed)
+		})
+	if err != nil {
+		// handler might have modified the cached state in place
+		delete(worker.entityCache, entityId)
+		return nil, err
+	}
+	stateJson := event.State
+	err = store.encodeDelta(entity, event)
+	if err != nil {
+		delete(worker.entityCache, entityId)
+		return nil, err
+	}
+	if event.Tombstone {
+		entity = &Entity{EntityId: entityId, Deleted: true}
+	} else if newState != nil {
+		entity.State = newState
+	}
+	entity.StateJson = stateJson
+	entity.Version = event.Version
+	entity.snapshotVersion = event.DeltaBase
+	if entity.snapshotVersion == 0 && !event.Tombstone {
+		entity.snapshotVersion = event.Version
+	}
+	worker.entityCache[entityId] = entity
+	return event, nil
+}
+
+// loadEntity prepares the entity according to the command mode,
+// the committed event is returned if the command turns out to be handled before
+func (worker *worker) loadEntity(command *command) (entity *Entity, committed *Event, err error) {
+	entityId := command.entityId
+	entity = worker.entityCache[entityId]
+	mode := worker.store.commandModes[command.commandName]
+	if entity != nil && entity.Deleted && (mode == MustExist || mode == Delete) {
+		// do not reject by the cache, the entity might have been created again by other worker
+		entity = nil
+	}
+	if entity == nil && mode != MustNotExist {
+		entity, err = worker.store.loadLatest(worker.backend, entityId)
+		if err == ErrNotFound {
+			entity, err = nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if entity != nil {
 			worker.entityCache[entityId] = entity
 		}
 	}
-	requestObj := store.commandRequestTypes[commandName]()
-	if requestObj != nil {
-		err = store.cfg.jsonApi.Unmarshal(request, requestObj)
+	switch mode {
+	case MustNotExist:
+		if entity == nil {
+			// rely on the unique constraint, instead of reading the database for every new entity
+			return &Entity{EntityId: entityId}, nil, nil
+		}
+		if entity.Deleted {
+			// continue the version after tombstone
+			return &Entity{EntityId: entityId, Version: entity.Version}, nil, nil
+		}
+		committed, err = worker.getCommitted(command)
+		if err != nil || committed != nil {
+			return nil, committed, err
+		}
+		return nil, nil, fmt.Errorf("%w: %v", ErrAlreadyExists, entityId)
+	case CreateIfAbsent:
+		if entity == nil {
+			return &Entity{EntityId: entityId}, nil, nil
+		}
+		if entity.Deleted {
+			return &Entity{EntityId: entityId, Version: entity.Version}, nil, nil
+		}
+		return entity, nil, nil
+	default:
+		if entity != nil && !entity.Deleted {
+			return entity, nil, nil
+		}
+		committed, err = worker.getCommitted(command)
+		if err != nil || committed != nil {
+			return nil, committed, err
+		}
+		return nil, nil, fmt.Errorf("%w: entity %v does not exist", ErrNotFound, entityId)
+	}
+}
+
+// getCommitted returns nil without error if the command has not been committed
+func (worker *worker) getCommitted(command *command) (*Event, error) {
+	committed, err := worker.backend.GetByCommandId(command.entityId, command.commandId)
+	if err == ErrNotFound {
+		return nil, nil
+	}
+	return committed, backendFailure(err)
+}
+
+// checkExpectedVersion is called when the entity version does not match.
+// The command might have been committed before, it should not be a conflict.
+// The cached version includes the pending events of the batch, older expected version fails fast.
+// Newer expected version means the cache might be stale, it is reloaded if nothing pending in the batch,
+// otherwise the batch insert would fail anyway, and the command is retried alone.
+func (worker *worker) checkExpectedVersion(command *command, cached *Entity) (entity *Entity, committed *Event, err error) {
+	committed, err = worker.getCommitted(command)
+	if err != nil || committed != nil {
+		return nil, committed, err
+	}
+	if command.expectedVersion < cached.Version || worker.pending[command.entityId] {
+		return nil, nil, versionConflict(fmt.Errorf(
+			"expected version %v, actual version %v", command.expectedVersion, cached.Version))
+	}
+	delete(worker.entityCache, command.entityId)
+	entity, committed, err = worker.loadEntity(command)
+	if err != nil || committed != nil {
+		return nil, committed, err
+	}
+	if entity.Version != command.expectedVersion {
+		return nil, nil, versionConflict(fmt.Errorf(
+			"expected version %v, actual version %v", command.expectedVersion, entity.Version))
+	}
+	return entity, nil, nil
+}
+
+// execute runs the handler against the entity, the entity itself is not updated.
+// observe is called with the duration of the handler if it is not nil.
+// Middlewares are skipped if withMiddlewares is false, replay only re-runs the handlers.
+func (store *entityStore) execute(entity *Entity, commandId string, commandName string, request []byte,
+	withMiddlewares bool, observe func(elapsed time.Duration)) (event *Event, newState interface{}, err error) {
+	handleCommand := store.commandHandlers[commandName]
+	if handleCommand == nil {
+		return nil, nil, fmt.Errorf("%w: no handler defined for command %v", ErrUnknownCommand, commandName)
+	}
+	err = store.validate(store.requestSchemas[commandName], "request", request)
+	if err != nil {
+		return nil, nil, err
+	}
+	var requestObj interface{}
+	if requestType := store.commandRequestTypes[commandName]; requestType != nil {
+		requestObj = requestType()
+	}
+	if requestObj != nil && len(request) > 0 {
+		err = store.codec.Unmarshal(request, requestObj)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
-	responseObj, newState, err := handleCommand(requestObj, entity.State)
+	if withMiddlewares {
+		handleCommand = store.applyMiddlewares(&CommandContext{
+			EntityId:    entity.EntityId,
+			CommandId:   commandId,
+			CommandName: commandName,
+			Version:     entity.Version,
+			Request:     request,
+		}, handleCommand)
+	}
+	responseObj, newState, err := store.callHandlerWithBudget(commandName, handleCommand, requestObj, entity.State,
+		observe)
 	if err != nil {
 		return nil, nil, err
 	}
-	response, err = store.cfg.jsonApi.Marshal(responseObj)
+	var domainEvents []byte
+	var outbox []byte
+	if result, isResult := responseObj.(*Result); isResult {
+		responseObj = result.Response
+		if len(result.Events) > 0 {
+			domainEvents, err = store.codec.Marshal(result.Events)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		messages := result.outboxMessages()
+		if len(messages) > 0 {
+			outbox, err = store.codec.Marshal(messages)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	response, err := store.codec.Marshal(responseObj)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -315,22 +711,32 @@ func (worker *worker) tryHandleOne(command *command) (row []driver.Value, respon
 	if newState == nil {
 		newStateJson = entity.StateJson
 	} else {
-		newStateJson, err = store.cfg.jsonApi.Marshal(newState)
+		newStateJson, err = store.codec.Marshal(newState)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = store.validate(store.stateSchema, "state", newStateJson)
 		if err != nil {
 			return nil, nil, err
 		}
 	}
-	row = sql.BatchInsertRow(
-		"entity_id", entityId,
-		"version", entity.Version+1,
-		"command_id", commandId,
-		"command_name", commandName,
-		"request", request,
-		"response", response,
-		"state", newStateJson)
-	entity.State = newState
-	entity.StateJson = newStateJson
-	entity.Version += 1
-	worker.entityCache[entityId] = entity
-	return row, response, nil
+	event = &Event{
+		EntityId:     entity.EntityId,
+		Version:      entity.Version + 1,
+		CommandId:    commandId,
+		CommandName:  commandName,
+		Request:      request,
+		Response:     response,
+		State:        newStateJson,
+		StateVersion: store.stateVersion,
+		DomainEvents: domainEvents,
+		Outbox:       outbox,
+		Codec:        store.codecName,
+	}
+	if store.commandModes[commandName] == Delete {
+		event.State, _ = store.codec.Marshal(nil)
+		event.Tombstone = true
+		newState = nil
+	}
+	return event, newState, nil
 }
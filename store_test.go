@@ -2,6 +2,7 @@ package quokka
 
 import (
 	"testing"
+	"errors"
 	"github.com/go-sql-driver/mysql"
 	"github.com/json-iterator/go/require"
 	"fmt"
@@ -24,7 +25,10 @@ type ResponseMessage struct {
 	Errmsg string
 }
 
-var accounts = StoreOf("account").
+var accounts = defineAccount(StoreOf("account"))
+
+func defineAccount(store *entityStore) *entityStore {
+	return store.
 	StateType(
 	func() interface{} {
 		return &Account{}
@@ -57,6 +61,21 @@ var accounts = StoreOf("account").
 			}, account, err
 		}
 	})
+}
+
+// newAccountStore defines the account store in a config of its own
+func newAccountStore() *entityStore {
+	return defineAccount(Config{}.Froze().StoreOf("account"))
+}
+
+// startAccount starts the worker with memory backend, and creates an account by it
+func startAccount(should *require.Assertions, store *entityStore) (*worker, string) {
+	worker := store.StartBackendWorker(NewMemoryBackend())
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	return worker, accountId
+}
 
 func Test_create(t *testing.T) {
 	should := require.New(t)
@@ -196,3 +215,20 @@ func Test_10000_run(t *testing.T) {
 	after := time.Now()
 	fmt.Println(1000000 / after.Sub(before).Seconds())
 }
+
+func Test_mysql_translate_error(t *testing.T) {
+	should := require.New(t)
+	duplicateEntry := func(message string) error {
+		return fmt.Errorf("insert: %w", &mysql.MySQLError{Number: 1062, Message: message})
+	}
+	should.True(errors.Is(DialectMySQL.TranslateError(duplicateEntry(
+		"Duplicate entry 'abc-1060' for key 'account.unique_version'")), ErrVersionConflict))
+	should.True(errors.Is(DialectMySQL.TranslateError(duplicateEntry(
+		"Duplicate entry 'abc-1060-unique_version' for key 'unique_command'")), ErrDuplicateCommand))
+	should.True(errors.Is(DialectMySQL.TranslateError(
+		&mysql.MySQLError{Number: 1060, Message: "Duplicate column name 'codec'"}), ErrDuplicateColumn))
+	// only the error number counts, not the digits in the message
+	err := DialectMySQL.TranslateError(errors.New("Error 1060 1062: unique_version'"))
+	should.False(errors.Is(err, ErrDuplicateColumn))
+	should.False(errors.Is(err, ErrVersionConflict))
+}
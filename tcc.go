@@ -0,0 +1,349 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TccPhase is the progress of the transaction recorded by the coordinator entity
+type TccPhase string
+
+const (
+	TccTrying     TccPhase = "trying"
+	TccConfirming TccPhase = "confirming"
+	TccCancelling TccPhase = "cancelling"
+	TccConfirmed  TccPhase = "confirmed"
+	TccCancelled  TccPhase = "cancelled"
+)
+
+// TccParticipant is the entity taking part in the transaction, the three commands are sent to it in turn.
+// Request is encoded by the codec of the participant store, it is same for try, confirm and cancel.
+type TccParticipant struct {
+	EntityName string
+	EntityId   string
+	Try        string
+	Confirm    string
+	Cancel     string
+	Request    []byte
+}
+
+// TccTransaction is the state of the coordinator entity, the entity id is the transaction id
+type TccTransaction struct {
+	Participants []TccParticipant
+	Phase        TccPhase
+	// Tried is the count of participants tried successfully, in the participants order
+	Tried int
+	// Cancelling is the count of participants to cancel, the failed one is included if its try was committed
+	Cancelling int
+	// Done is the count of participants confirmed or cancelled
+	Done   int
+	Reason string
+}
+
+type tccCancel struct {
+	Reason     string
+	Cancelling int
+}
+
+// TccStore defines the coordinator entity, see TccCoordinator
+func TccStore(entityName string) *entityStore {
+	return ConfigDefault.TccStore(entityName)
+}
+
+// TccStore defines the coordinator entity, its commands record the progress,
+// and respond the transaction after the progress
+func (cfg *frozenConfig) TccStore(entityName string) *entityStore {
+	return cfg.StoreOf(entityName).
+		StateType(func() interface{} {
+			return &TccTransaction{}
+		}).
+		CommandWithMode("begin", MustNotExist,
+			func() interface{} {
+				return &[]TccParticipant{}
+			},
+			func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+				participants := *(request.(*[]TccParticipant))
+				if len(participants) == 0 {
+					return nil, nil, errors.New("transaction should have at least one participant")
+				}
+				tx := &TccTransaction{Participants: participants, Phase: TccTrying}
+				return tx, tx, nil
+			}).
+		Command("tried",
+			func() interface{} {
+				var index int
+				return &index
+			},
+			func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+				tx := state.(*TccTransaction)
+				if tx.Phase == TccTrying && *(request.(*int)) == tx.Tried {
+					tx.Tried++
+					if tx.Tried == len(tx.Participants) {
+						tx.Phase = TccConfirming
+					}
+				}
+				return tx, tx, nil
+			}).
+		Command("cancel",
+			func() interface{} {
+				return &tccCancel{}
+			},
+			func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+				tx := state.(*TccTransaction)
+				cancel := request.(*tccCancel)
+				if tx.Phase == TccTrying {
+					tx.Phase = TccCancelling
+					tx.Reason = cancel.Reason
+					tx.Cancelling = cancel.Cancelling
+					if tx.Cancelling == 0 {
+						tx.Phase = TccCancelled
+					}
+				}
+				return tx, tx, nil
+			}).
+		Command("done",
+			func() interface{} {
+				var index int
+				return &index
+			},
+			func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+				tx := state.(*TccTransaction)
+				if *(request.(*int)) != tx.Done {
+					return tx, tx, nil
+				}
+				switch tx.Phase {
+				case TccConfirming:
+					tx.Done++
+					if tx.Done == len(tx.Participants) {
+						tx.Phase = TccConfirmed
+					}
+				case TccCancelling:
+					tx.Done++
+					if tx.Done == tx.Cancelling {
+						tx.Phase = TccCancelled
+					}
+				}
+				return tx, tx, nil
+			})
+}
+
+// TccCoordinator drives the try, confirm and cancel commands on the participants through their workers,
+// the participant stores must have started worker of the same config.
+// Command ids sent are derived from the transaction id, so the transaction can be resumed after crash.
+// Rejection of try cancels the transaction, transient error (see IsTransient) leaves it trying,
+// try again, confirm and cancel are retried by Resume until succeeded.
+type TccCoordinator struct {
+	worker *worker
+	// mutex protects the scan offset and in progress transactions of ResumeAll
+	mutex      *sync.Mutex
+	offset     int64
+	inProgress map[string]bool
+}
+
+// NewTccCoordinator takes the started worker of the TccStore
+func NewTccCoordinator(worker *worker) *TccCoordinator {
+	return &TccCoordinator{worker: worker, mutex: &sync.Mutex{}, inProgress: map[string]bool{}}
+}
+
+// TccResumeError collects the transactions failed to resume, keyed by transaction id
+type TccResumeError struct {
+	Failed map[string]error
+}
+
+func (err *TccResumeError) Error() string {
+	txIds := make([]string, 0, len(err.Failed))
+	for txId := range err.Failed {
+		txIds = append(txIds, txId)
+	}
+	sort.Strings(txIds)
+	descriptions := make([]string, 0, len(txIds))
+	for _, txId := range txIds {
+		descriptions = append(descriptions, txId+": "+err.Failed[txId].Error())
+	}
+	return "failed to resume tcc transactions: " + strings.Join(descriptions, "; ")
+}
+
+// Begin records the participants then drives the transaction to confirmed or cancelled.
+// Error means the transaction is left in the middle, it should be resumed later.
+func (coordinator *TccCoordinator) Begin(txId string, participants []TccParticipant) (*TccTransaction, error) {
+	request, err := coordinator.worker.store.codec.Marshal(participants)
+	if err != nil {
+		return nil, err
+	}
+	_, err = coordinator.worker.Handle(txId, "begin", "begin", request)
+	if err != nil {
+		return nil, err
+	}
+	return coordinator.Resume(txId)
+}
+
+// Resume continues the transaction from the progress recorded
+func (coordinator *TccCoordinator) Resume(txId string) (*TccTransaction, error) {
+	entity, err := coordinator.worker.store.GetFromBackend(coordinator.worker.backend, txId)
+	if err != nil {
+		return nil, err
+	}
+	tx := entity.State.(*TccTransaction)
+	for {
+		switch tx.Phase {
+		case TccTrying:
+			tx, err = coordinator.try(txId, tx)
+		case TccConfirming:
+			tx, err = coordinator.complete(txId, tx, tx.Participants[tx.Done].Confirm, "confirm")
+		case TccCancelling:
+			tx, err = coordinator.complete(txId, tx, tx.Participants[tx.Done].Cancel, "cancel")
+		default:
+			return tx, nil
+		}
+		if err != nil {
+			return tx, err
+		}
+	}
+}
+
+// ResumeAll resumes the transactions not completed yet, it should be called after restart, and periodically.
+// The coordinator log is scanned from where the last call stopped, the transactions seen in progress are tracked,
+// so only the new events and the transactions not completed are visited.
+// Failed transaction does not stop the others, the failures are returned as TccResumeError.
+func (coordinator *TccCoordinator) ResumeAll() error {
+	coordinator.mutex.Lock()
+	defer coordinator.mutex.Unlock()
+	err := coordinator.scanInProgress()
+	if err != nil {
+		return err
+	}
+	txIds := make([]string, 0, len(coordinator.inProgress))
+	for txId := range coordinator.inProgress {
+		txIds = append(txIds, txId)
+	}
+	sort.Strings(txIds)
+	resumeErr := &TccResumeError{Failed: map[string]error{}}
+	for _, txId := range txIds {
+		tx, err := coordinator.Resume(txId)
+		if errors.Is(err, ErrNotFound) || err == nil && tx.completed() {
+			delete(coordinator.inProgress, txId)
+			continue
+		}
+		if err != nil {
+			resumeErr.Failed[txId] = err
+		}
+	}
+	if len(resumeErr.Failed) > 0 {
+		return resumeErr
+	}
+	return nil
+}
+
+// scanInProgress reads the coordinator log after the offset, and tracks the transactions by their latest phase
+func (coordinator *TccCoordinator) scanInProgress() error {
+	store := coordinator.worker.store
+	for {
+		events, err := store.Scan(coordinator.worker.backend, coordinator.offset, 1000)
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		for _, event := range events {
+			entity, err := store.entityOf(event)
+			if err != nil {
+				return err
+			}
+			tx, _ := entity.State.(*TccTransaction)
+			if entity.Deleted || tx == nil || tx.completed() {
+				delete(coordinator.inProgress, event.EntityId)
+			} else {
+				coordinator.inProgress[event.EntityId] = true
+			}
+			coordinator.offset = event.EventId
+		}
+	}
+}
+
+func (tx *TccTransaction) completed() bool {
+	return tx.Phase == TccConfirmed || tx.Phase == TccCancelled
+}
+
+func (coordinator *TccCoordinator) try(txId string, tx *TccTransaction) (*TccTransaction, error) {
+	index := tx.Tried
+	participant := tx.Participants[index]
+	commandId := participantCommandId(txId, "try", index)
+	_, tryErr := coordinator.send(participant, commandId, participant.Try)
+	if tryErr == nil {
+		return coordinator.progress(txId, "tried-"+strconv.Itoa(index), "tried", index)
+	}
+	if IsTransient(tryErr) {
+		// not rejected, try again by Resume with the same command id
+		return tx, tryErr
+	}
+	cancelling := index
+	// the try might have been committed, even if the error is replied
+	if participantWorker, _ := coordinator.participantWorker(participant); participantWorker != nil {
+		_, err := participantWorker.backend.GetByCommandId(participant.EntityId, commandId)
+		if err == nil {
+			cancelling++
+		} else if err != ErrNotFound {
+			return tx, err
+		}
+	}
+	return coordinator.progress(txId, "cancel", "cancel", &tccCancel{
+		Reason:     fmt.Sprintf("participant %v %v failed to %v: %v", participant.EntityName, participant.EntityId, participant.Try, tryErr),
+		Cancelling: cancelling,
+	})
+}
+
+func (coordinator *TccCoordinator) complete(txId string, tx *TccTransaction, commandName string, action string) (
+	*TccTransaction, error) {
+	index := tx.Done
+	participant := tx.Participants[index]
+	_, err := coordinator.send(participant, participantCommandId(txId, action, index), commandName)
+	if err != nil {
+		return tx, err
+	}
+	return coordinator.progress(txId, action+"-"+strconv.Itoa(index), "done", index)
+}
+
+func (coordinator *TccCoordinator) send(participant TccParticipant, commandId string, commandName string) ([]byte, error) {
+	participantWorker, err := coordinator.participantWorker(participant)
+	if err != nil {
+		return nil, err
+	}
+	return participantWorker.Handle(participant.EntityId, commandId, commandName, participant.Request)
+}
+
+func (coordinator *TccCoordinator) participantWorker(participant TccParticipant) (*worker, error) {
+	participantWorker := coordinator.worker.store.cfg.workerOf(participant.EntityName)
+	if participantWorker == nil {
+		return nil, fmt.Errorf("no worker started for participant entity: %v", participant.EntityName)
+	}
+	return participantWorker, nil
+}
+
+// progress records the progress in the coordinator entity, and returns the transaction after it
+func (coordinator *TccCoordinator) progress(txId string, commandId string, commandName string,
+	request interface{}) (*TccTransaction, error) {
+	store := coordinator.worker.store
+	requestBytes, err := store.codec.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	response, err := coordinator.worker.Handle(txId, commandId, commandName, requestBytes)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := store.decodeState(response)
+	if err != nil {
+		return nil, err
+	}
+	return tx.(*TccTransaction), nil
+}
+
+// participantCommandId is unique in the participant entity, even if it takes part in the transaction twice
+func participantCommandId(txId string, action string, index int) string {
+	return txId + "-" + action + "-" + strconv.Itoa(index)
+}
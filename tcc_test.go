@@ -0,0 +1,210 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"github.com/json-iterator/go/require"
+)
+
+func defineTccAccount(cfg *frozenConfig) *entityStore {
+	amountOf := func() interface{} {
+		var amount int64
+		return &amount
+	}
+	return cfg.StoreOf("tcc_account").
+		StateType(func() interface{} {
+		return &Account{}
+	}).
+		Command("create", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return ResponseMessage{}, &Account{UsableBalance: *(request.(*int64))}, nil
+		}).
+		Command("try_debit", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			amount := *(request.(*int64))
+			account := state.(*Account)
+			if account.UsableBalance < amount {
+				return nil, nil, errors.New("insufficient balance")
+			}
+			return ResponseMessage{}, &Account{
+				UsableBalance: account.UsableBalance - amount,
+				FrozenBalance: account.FrozenBalance + amount,
+			}, nil
+		}).
+		Command("confirm_debit", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account := state.(*Account)
+			return ResponseMessage{}, &Account{
+				UsableBalance: account.UsableBalance,
+				FrozenBalance: account.FrozenBalance - *(request.(*int64)),
+			}, nil
+		}).
+		Command("cancel_debit", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			amount := *(request.(*int64))
+			account := state.(*Account)
+			return ResponseMessage{}, &Account{
+				UsableBalance: account.UsableBalance + amount,
+				FrozenBalance: account.FrozenBalance - amount,
+			}, nil
+		}).
+		Command("try_credit", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return ResponseMessage{}, nil, nil
+		}).
+		Command("confirm_credit", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			account := state.(*Account)
+			return ResponseMessage{}, &Account{
+				UsableBalance: account.UsableBalance + *(request.(*int64)),
+				FrozenBalance: account.FrozenBalance,
+			}, nil
+		}).
+		Command("cancel_credit", amountOf,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			return ResponseMessage{}, nil, nil
+		})
+}
+
+func transferParticipants(from string, to string, amount string) []TccParticipant {
+	return []TccParticipant{
+		{EntityName: "tcc_account", EntityId: from,
+			Try: "try_debit", Confirm: "confirm_debit", Cancel: "cancel_debit", Request: []byte(amount)},
+		{EntityName: "tcc_account", EntityId: to,
+			Try: "try_credit", Confirm: "confirm_credit", Cancel: "cancel_credit", Request: []byte(amount)},
+	}
+}
+
+func Test_tcc_transfer(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	accountBackend := NewMemoryBackend()
+	tccAccounts := defineTccAccount(cfg)
+	accountWorker := tccAccounts.StartBackendWorker(accountBackend)
+	coordinator := NewTccCoordinator(cfg.TccStore("transfer").StartBackendWorker(NewMemoryBackend()))
+	from := NewID().String()
+	to := NewID().String()
+	_, err := accountWorker.Handle(from, "create", "create", []byte("100"))
+	should.Nil(err)
+	_, err = accountWorker.Handle(to, "create", "create", []byte("0"))
+	should.Nil(err)
+	tx, err := coordinator.Begin("tx-001", transferParticipants(from, to, "30"))
+	should.Nil(err)
+	should.Equal(TccConfirmed, tx.Phase)
+	tx, err = coordinator.Begin("tx-001", transferParticipants(from, to, "30"))
+	should.Nil(err)
+	should.Equal(TccConfirmed, tx.Phase)
+	tx, err = coordinator.Begin("tx-002", transferParticipants(from, to, "200"))
+	should.Nil(err)
+	should.Equal(TccCancelled, tx.Phase)
+	should.Equal(0, tx.Cancelling)
+	tx, err = coordinator.Begin("tx-003", transferParticipants(from, "not-exist", "10"))
+	should.Nil(err)
+	should.Equal(TccCancelled, tx.Phase)
+	should.Equal(1, tx.Cancelling)
+	fromAccount, err := tccAccounts.GetFromBackend(accountBackend, from)
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 70}, *fromAccount.State.(*Account))
+	toAccount, err := tccAccounts.GetFromBackend(accountBackend, to)
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 30}, *toAccount.State.(*Account))
+}
+
+func Test_tcc_resume(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	accountBackend := NewMemoryBackend()
+	tccAccounts := defineTccAccount(cfg)
+	accountWorker := tccAccounts.StartBackendWorker(accountBackend)
+	coordinatorWorker := cfg.TccStore("transfer").StartBackendWorker(NewMemoryBackend())
+	from := NewID().String()
+	to := NewID().String()
+	_, err := accountWorker.Handle(from, "create", "create", []byte("100"))
+	should.Nil(err)
+	_, err = accountWorker.Handle(to, "create", "create", []byte("0"))
+	should.Nil(err)
+	// crashed after the first participant tried
+	request, err := coordinatorWorker.store.codec.Marshal(transferParticipants(from, to, "30"))
+	should.Nil(err)
+	_, err = coordinatorWorker.Handle("tx-001", "begin", "begin", request)
+	should.Nil(err)
+	_, err = accountWorker.Handle(from, participantCommandId("tx-001", "try", 0), "try_debit", []byte("30"))
+	should.Nil(err)
+	should.Nil(NewTccCoordinator(coordinatorWorker).ResumeAll())
+	fromAccount, err := tccAccounts.GetFromBackend(accountBackend, from)
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 70}, *fromAccount.State.(*Account))
+	toAccount, err := tccAccounts.GetFromBackend(accountBackend, to)
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 30}, *toAccount.State.(*Account))
+}
+
+func Test_tcc_transient_try_error_is_retried(t *testing.T) {
+	should := require.New(t)
+	cfg := Config{}.Froze()
+	accountBackend := NewMemoryBackend()
+	// read by the worker goroutine
+	flaky := int32(1)
+	tccAccounts := defineTccAccount(cfg).
+		Command("try_flaky", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			if atomic.LoadInt32(&flaky) == 1 {
+				return nil, nil, fmt.Errorf("%w: busy", ErrOverloaded)
+			}
+			return ResponseMessage{}, nil, nil
+		})
+	accountWorker := tccAccounts.StartBackendWorker(accountBackend)
+	coordinatorWorker := cfg.TccStore("transfer").StartBackendWorker(NewMemoryBackend())
+	coordinator := NewTccCoordinator(coordinatorWorker)
+	to := NewID().String()
+	_, err := accountWorker.Handle(to, "create", "create", []byte("0"))
+	should.Nil(err)
+	participants := []TccParticipant{{EntityName: "tcc_account", EntityId: to,
+		Try: "try_flaky", Confirm: "confirm_credit", Cancel: "cancel_credit", Request: []byte("10")}}
+	tx, err := coordinator.Begin("tx-001", participants)
+	should.True(IsTransient(err))
+	should.Equal(TccTrying, tx.Phase)
+	// the confirm of tx-002 never succeeds, it should not block tx-001
+	stuck := []TccParticipant{{EntityName: "tcc_account", EntityId: to,
+		Try: "try_credit", Confirm: "confirm_unknown", Cancel: "cancel_credit", Request: []byte("10")}}
+	tx, err = coordinator.Begin("tx-002", stuck)
+	should.True(errors.Is(err, ErrUnknownCommand))
+	should.Equal(TccConfirming, tx.Phase)
+	atomic.StoreInt32(&flaky, 0)
+	err = coordinator.ResumeAll()
+	var resumeErr *TccResumeError
+	should.True(errors.As(err, &resumeErr))
+	should.Equal(1, len(resumeErr.Failed))
+	should.NotNil(resumeErr.Failed["tx-002"])
+	toAccount, err := tccAccounts.GetFromBackend(accountBackend, to)
+	should.Nil(err)
+	should.Equal(Account{UsableBalance: 10}, *toAccount.State.(*Account))
+	should.Equal(map[string]bool{"tx-002": true}, coordinator.inProgress)
+}
+
+func Test_unique_key_conflict_is_not_transient(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	store := defineAccount(Config{}.Froze().StoreOf("account"))
+	newWorker := func() *worker {
+		return &worker{
+			store:       store,
+			backend:     backend,
+			entityCache: map[string]*Entity{},
+			inFlight:    newInFlight(),
+			rateLimiter: newRateLimiter(),
+			stats:       workerStats{durations: newCommandDurations()},
+		}
+	}
+	// two workers share the backend, the first one has cached the entity at version 1
+	first, second := newWorker(), newWorker()
+	accountId := NewID().String()
+	should.Nil(first.batchProcess([]*command{first.newCommand(accountId, "create", "create", nil, AnyVersion)}))
+	should.Nil(second.batchProcess([]*command{second.newCommand(accountId, "xxx-001", "transfer1pc", []byte("1"), AnyVersion)}))
+	err := first.batchProcess([]*command{first.newCommand(accountId, "xxx-002", "transfer1pc", []byte("1"), AnyVersion)})
+	should.True(errors.Is(err, ErrVersionConflict))
+	should.False(errors.Is(err, ErrBackend))
+	should.False(IsTransient(err))
+}
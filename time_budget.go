@@ -0,0 +1,175 @@
+package quokka
+
+import (
+	"errors"
+	"fmt"
+	"github.com/v2pro/plz"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var slowCommands = plz.Logger("metric", "slow_command")
+
+// ErrTimeBudgetExceeded is replied if the handler does not return within the budget, see FailOverBudget
+var ErrTimeBudgetExceeded = errors.New("quokka: time budget exceeded")
+
+// TimeBudget is the budget of every command, command exceeding it is logged as slow command
+func (store *entityStore) TimeBudget(budget time.Duration) *entityStore {
+	store.timeBudget = budget
+	return store
+}
+
+// CommandTimeBudget overrides the TimeBudget for the command
+func (store *entityStore) CommandTimeBudget(commandName string, budget time.Duration) *entityStore {
+	store.commandTimeBudgets[commandName] = budget
+	return store
+}
+
+// FailOverBudget stops waiting for the handler when the budget is exceeded, and replies ErrTimeBudgetExceeded.
+// The handler keeps running in its own goroutine, its result is discarded.
+// While too many of them are still running, see MaxOverBudget, the commands with budget are replied
+// ErrTimeBudgetExceeded without calling the handler, Handle and HandleAsync included.
+// Every command with budget is handled in a new goroutine with a timer, with TimeBudget set that is every command.
+func (store *entityStore) FailOverBudget() *entityStore {
+	store.failOverBudget = true
+	return store
+}
+
+// MaxOverBudget limits the handlers still running after the budget exceeded, 100 by default.
+// Commands with budget fail fast with ErrTimeBudgetExceeded when the limit is reached.
+func (store *entityStore) MaxOverBudget(limit int) *entityStore {
+	store.maxOverBudget = int64(limit)
+	return store
+}
+
+func (store *entityStore) timeBudgetOf(commandName string) time.Duration {
+	if budget, found := store.commandTimeBudgets[commandName]; found {
+		return budget
+	}
+	return store.timeBudget
+}
+
+type handlerResult struct {
+	response interface{}
+	newState interface{}
+	err      error
+}
+
+const (
+	handlerRunning int32 = iota
+	handlerReturned
+	handlerAbandoned
+)
+
+// callHandlerWithBudget calls the handler in other goroutine if the command should fail over budget.
+// observe is called with the time spent on the handler, if it is not nil.
+func (store *entityStore) callHandlerWithBudget(commandName string, handleCommand HandleCommand,
+	request interface{}, state interface{}, observe func(elapsed time.Duration)) (interface{}, interface{}, error) {
+	budget := store.timeBudgetOf(commandName)
+	if store.failOverBudget && budget > 0 && atomic.LoadInt64(&store.overBudget) >= store.maxOverBudget {
+		return nil, nil, fmt.Errorf("%w: %v handlers are still running over budget",
+			ErrTimeBudgetExceeded, atomic.LoadInt64(&store.overBudget))
+	}
+	start := time.Now()
+	if observe != nil {
+		defer func() {
+			observe(time.Since(start))
+		}()
+	}
+	if !store.failOverBudget || budget <= 0 {
+		return callHandler(commandName, handleCommand, request, state)
+	}
+	resultQ := make(chan handlerResult, 1)
+	status := handlerRunning
+	go func() {
+		response, newState, err := callHandler(commandName, handleCommand, request, state)
+		resultQ <- handlerResult{response, newState, err}
+		if !atomic.CompareAndSwapInt32(&status, handlerRunning, handlerReturned) {
+			atomic.AddInt64(&store.overBudget, -1)
+		}
+	}()
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case result := <-resultQ:
+		return result.response, result.newState, result.err
+	case <-timer.C:
+		if !atomic.CompareAndSwapInt32(&status, handlerRunning, handlerAbandoned) {
+			// returned just now
+			result := <-resultQ
+			return result.response, result.newState, result.err
+		}
+		atomic.AddInt64(&store.overBudget, 1)
+		return nil, nil, fmt.Errorf("%w: %v did not return in %v", ErrTimeBudgetExceeded, commandName, budget)
+	}
+}
+
+// commandDurations is written by the worker goroutine and read by the admin endpoints
+type commandDurations struct {
+	mutex  *sync.Mutex
+	byName map[string]*commandDuration
+}
+
+type commandDuration struct {
+	count      int64
+	total      time.Duration
+	max        time.Duration
+	overBudget int64
+}
+
+type commandDurationStatus struct {
+	Count      int64   `json:"count"`
+	AvgMs      float64 `json:"avg_ms"`
+	MaxMs      float64 `json:"max_ms"`
+	OverBudget int64   `json:"over_budget"`
+}
+
+func newCommandDurations() *commandDurations {
+	return &commandDurations{mutex: &sync.Mutex{}, byName: map[string]*commandDuration{}}
+}
+
+func (worker *worker) observeDuration(cmd *command, elapsed time.Duration) {
+	budget := worker.store.timeBudgetOf(cmd.commandName)
+	overBudget := budget > 0 && elapsed > budget
+	durations := worker.stats.durations
+	durations.mutex.Lock()
+	duration := durations.byName[cmd.commandName]
+	if duration == nil {
+		duration = &commandDuration{}
+		durations.byName[cmd.commandName] = duration
+	}
+	duration.count++
+	duration.total += elapsed
+	if elapsed > duration.max {
+		duration.max = elapsed
+	}
+	if overBudget {
+		duration.overBudget++
+	}
+	durations.mutex.Unlock()
+	if overBudget {
+		slowCommands.Warn("slow command",
+			"entity_name", worker.store.entityName,
+			"entity_id", cmd.entityId,
+			"command_id", cmd.commandId,
+			"command_name", cmd.commandName,
+			"duration_ms", elapsed.Seconds()*1000,
+			"budget_ms", budget.Seconds()*1000)
+	}
+}
+
+func (durations *commandDurations) status() map[string]commandDurationStatus {
+	durations.mutex.Lock()
+	defer durations.mutex.Unlock()
+	statuses := map[string]commandDurationStatus{}
+	for commandName, duration := range durations.byName {
+		statuses[commandName] = commandDurationStatus{
+			Count:      duration.count,
+			AvgMs:      duration.total.Seconds() * 1000 / float64(duration.count),
+			MaxMs:      duration.max.Seconds() * 1000,
+			OverBudget: duration.overBudget,
+		}
+	}
+	return statuses
+}
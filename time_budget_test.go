@@ -0,0 +1,78 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"time"
+	"sync/atomic"
+	"github.com/json-iterator/go/require"
+)
+
+func defineSlowAccount() *entityStore {
+	return newAccountStore().
+		Command("slow", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			time.Sleep(50 * time.Millisecond)
+			account := state.(*Account)
+			return ResponseMessage{}, &Account{UsableBalance: account.UsableBalance + 1}, nil
+		}).
+		TimeBudget(time.Second).
+		CommandTimeBudget("slow", 10*time.Millisecond)
+}
+
+func Test_slow_command_is_observed(t *testing.T) {
+	should := require.New(t)
+	worker, accountId := startAccount(should, defineSlowAccount())
+	_, err := worker.Handle(accountId, "slow-001", "slow", nil)
+	should.Nil(err)
+	durations := worker.stats.durations.status()
+	should.Equal(int64(1), durations["slow"].Count)
+	should.Equal(int64(1), durations["slow"].OverBudget)
+	should.True(durations["slow"].MaxMs >= 50)
+	should.Equal(int64(0), durations["create"].OverBudget)
+}
+
+func Test_fail_over_budget(t *testing.T) {
+	should := require.New(t)
+	store := defineSlowAccount().FailOverBudget()
+	worker, accountId := startAccount(should, store)
+	_, err := worker.Handle(accountId, "slow-001", "slow", nil)
+	should.True(errors.Is(err, ErrTimeBudgetExceeded))
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	account, err := store.GetFromBackend(worker.backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(100), account.State.(*Account).UsableBalance)
+	should.Equal(int64(2), account.Version)
+}
+
+func Test_handlers_over_budget_are_bounded(t *testing.T) {
+	should := require.New(t)
+	unblock := make(chan bool)
+	calls := int32(0)
+	store := newAccountStore().
+		Command("hang", nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			atomic.AddInt32(&calls, 1)
+			<-unblock
+			return ResponseMessage{}, state, nil
+		}).
+		CommandTimeBudget("hang", 10*time.Millisecond).FailOverBudget().MaxOverBudget(1)
+	worker, accountId := startAccount(should, store)
+	_, err := worker.Handle(accountId, "hang-001", "hang", nil)
+	should.True(errors.Is(err, ErrTimeBudgetExceeded))
+	// the abandoned handler is still running, the handler is not called again
+	_, err = worker.Handle(accountId, "hang-002", "hang", nil)
+	should.True(errors.Is(err, ErrTimeBudgetExceeded))
+	should.Equal(int32(1), atomic.LoadInt32(&calls))
+	// command without budget is not affected
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	close(unblock)
+	for atomic.LoadInt64(&store.overBudget) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	_, err = worker.Handle(accountId, "hang-003", "hang", nil)
+	should.Nil(err)
+	should.Equal(int32(2), atomic.LoadInt32(&calls))
+}
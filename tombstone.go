@@ -0,0 +1,27 @@
+package quokka
+
+import (
+	"fmt"
+	"github.com/v2pro/plz/sql"
+)
+
+// Purge physically removes the history of a deleted entity, for data retention.
+// The entity must have been deleted by a Delete command first.
+//
+// The command ids are purged together with the history, so idempotency does not survive purge:
+// a command retried after purge is handled again as new, a create command might create the entity again.
+// Purge only after the clients stop retrying the commands of the entity.
+func (store *entityStore) Purge(conn sql.Conn, entityId string) error {
+	return store.PurgeFromBackend(store.SqlBackend(conn), entityId)
+}
+
+func (store *entityStore) PurgeFromBackend(backend Backend, entityId string) error {
+	latest, err := store.loadLatest(backend, entityId)
+	if err != nil {
+		return err
+	}
+	if !latest.Deleted {
+		return fmt.Errorf("entity %v is not deleted, only deleted entity can be purged", entityId)
+	}
+	return backend.DeleteHistory(entityId, latest.Version)
+}
@@ -0,0 +1,61 @@
+package quokka
+
+import (
+	"testing"
+	"errors"
+	"github.com/json-iterator/go/require"
+)
+
+func Test_delete_and_purge(t *testing.T) {
+	should := require.New(t)
+	store := defineAccount(Config{}.Froze().StoreOf("account")).
+		CommandWithMode("close", Delete, nil,
+		func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+			if state.(*Account).UsableBalance != 0 {
+				return nil, nil, errors.New("balance not zero")
+			}
+			return "closed", nil, nil
+		})
+	backend := NewMemoryBackend()
+	worker := store.StartBackendWorker(backend)
+	accountId := NewID().String()
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	_, err = worker.Handle(accountId, "xxx-001", "transfer1pc", []byte("100"))
+	should.Nil(err)
+	should.NotNil(store.PurgeFromBackend(backend, accountId))
+	_, err = worker.Handle(accountId, "close-001", "close", nil)
+	should.Equal("balance not zero", err.Error())
+	_, err = worker.Handle(accountId, "xxx-002", "transfer1pc", []byte("-100"))
+	should.Nil(err)
+	response, err := worker.Handle(accountId, "close-002", "close", nil)
+	should.Nil(err)
+	should.Equal(`"closed"`, string(response))
+	// retry of the delete command is idempotent
+	response, err = worker.Handle(accountId, "close-002", "close", nil)
+	should.Nil(err)
+	should.Equal(`"closed"`, string(response))
+	_, err = store.GetFromBackend(backend, accountId)
+	should.True(errors.Is(err, ErrNotFound))
+	_, err = worker.Handle(accountId, "xxx-003", "transfer1pc", []byte("100"))
+	should.True(errors.Is(err, ErrNotFound))
+	_, err = store.StartBackendWorker(backend).Handle(accountId, "xxx-004", "transfer1pc", []byte("100"))
+	should.True(errors.Is(err, ErrNotFound))
+	events, err := backend.ScanByOffset(0, 100)
+	should.Nil(err)
+	should.True(events[len(events)-1].Tombstone)
+
+	// created again by other worker, which does not know about the tombstone
+	_, err = store.StartBackendWorker(backend).Handle(accountId, "create-again", "create", nil)
+	should.Nil(err)
+	account, err := store.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(5), account.Version)
+
+	_, err = worker.Handle(accountId, "close-003", "close", nil)
+	should.Nil(err)
+	should.Nil(store.PurgeFromBackend(backend, accountId))
+	history, err := store.History(backend, accountId)
+	should.Nil(err)
+	should.Equal(0, len(history))
+}
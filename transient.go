@@ -0,0 +1,42 @@
+package quokka
+
+import (
+	"errors"
+)
+
+// ErrBackend is matched by errors.Is when the command failed because the backend failed,
+// the original error is still in the chain
+var ErrBackend = errors.New("quokka: backend failure")
+
+type backendError struct {
+	err error
+}
+
+func (err *backendError) Error() string {
+	return err.err.Error()
+}
+
+func (err *backendError) Unwrap() error {
+	return err.err
+}
+
+func (err *backendError) Is(target error) bool {
+	return target == ErrBackend
+}
+
+// backendFailure marks the error of backend. ErrNotFound and the unique constraint violations translated
+// by the dialect are returned as they are, they are answers of the backend rather than failures.
+func backendFailure(err error) error {
+	if err == nil || err == ErrNotFound || errors.Is(err, ErrVersionConflict) || errors.Is(err, ErrDuplicateCommand) {
+		return err
+	}
+	return &backendError{err}
+}
+
+// IsTransient tells if sending the command again with the same command id might succeed:
+// the worker is overloaded or rate limited, the handler exceeded its time budget, or the backend failed.
+// Rejections by handler, schema, command mode and expected version are not transient.
+func IsTransient(err error) bool {
+	return errors.Is(err, ErrOverloaded) || errors.Is(err, ErrRateLimited) ||
+		errors.Is(err, ErrTimeBudgetExceeded) || errors.Is(err, ErrBackend)
+}
@@ -0,0 +1,87 @@
+package quokka
+
+import (
+	"time"
+	"github.com/v2pro/plz/sql"
+)
+
+// TypedStore is entityStore with the state type known at compile time
+type TypedStore[S any] struct {
+	store *entityStore
+}
+
+type TypedEntity[S any] struct {
+	EntityId  string
+	Version   int64
+	StateJson []byte
+	State     *S
+	UpdatedAt time.Time
+}
+
+// TypedHandleCommand gets nil state when the entity is being created
+type TypedHandleCommand[S any, Req any, Resp any] func(request *Req, state *S) (response Resp, newState *S, err error)
+
+func TypedStoreOf[S any](entityName string) *TypedStore[S] {
+	return NewTypedStore[S](StoreOf(entityName))
+}
+
+func NewTypedStore[S any](store *entityStore) *TypedStore[S] {
+	store.StateType(func() interface{} {
+		return new(S)
+	})
+	return &TypedStore[S]{store}
+}
+
+// Command registers typed handler, go does not allow method to have its own type parameters.
+// The command mode is decided by the command name, same as entityStore.Command
+func Command[S any, Req any, Resp any](store *TypedStore[S], commandName string,
+	handleCommand TypedHandleCommand[S, Req, Resp]) *TypedStore[S] {
+	return CommandWithMode(store, commandName, defaultCommandMode(commandName), handleCommand)
+}
+
+func CommandWithMode[S any, Req any, Resp any](store *TypedStore[S], commandName string, mode CommandMode,
+	handleCommand TypedHandleCommand[S, Req, Resp]) *TypedStore[S] {
+	store.store.CommandWithMode(commandName, mode, func() interface{} {
+		return new(Req)
+	}, func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+		typedState, _ := state.(*S)
+		response, newState, err := handleCommand(request.(*Req), typedState)
+		if newState == nil {
+			// typed nil pointer should not be mistaken as new state
+			return response, nil, err
+		}
+		return response, newState, err
+	})
+	return store
+}
+
+// Untyped gives the underlying entityStore to start worker
+func (store *TypedStore[S]) Untyped() *entityStore {
+	return store.store
+}
+
+func (store *TypedStore[S]) StartWorker(conn sql.Conn) *worker {
+	return store.store.StartWorker(conn)
+}
+
+func (store *TypedStore[S]) StartBackendWorker(backend Backend) *worker {
+	return store.store.StartBackendWorker(backend)
+}
+
+func (store *TypedStore[S]) Get(conn sql.Conn, entityId string) (*TypedEntity[S], error) {
+	return store.GetFromBackend(store.store.SqlBackend(conn), entityId)
+}
+
+func (store *TypedStore[S]) GetFromBackend(backend Backend, entityId string) (*TypedEntity[S], error) {
+	entity, err := store.store.GetFromBackend(backend, entityId)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedEntity[S]{
+		EntityId:  entity.EntityId,
+		Version:   entity.Version,
+		StateJson: entity.StateJson,
+		State:     entity.State.(*S),
+		UpdatedAt: entity.UpdatedAt,
+	}, nil
+}
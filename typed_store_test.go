@@ -0,0 +1,50 @@
+package quokka
+
+import (
+	"testing"
+	"github.com/json-iterator/go/require"
+	"github.com/json-iterator/go"
+)
+
+type TransferRequest struct {
+	Amount int64
+}
+
+var typedAccounts = defineTypedAccount(NewTypedStore[Account](Config{}.Froze().StoreOf("account")))
+
+func defineTypedAccount(store *TypedStore[Account]) *TypedStore[Account] {
+	Command(store, "create",
+		func(request *struct{}, state *Account) (ResponseMessage, *Account, error) {
+			return ResponseMessage{Errno: 0}, &Account{}, nil
+		})
+	Command(store, "transfer",
+		func(request *TransferRequest, state *Account) (ResponseMessage, *Account, error) {
+			if state.UsableBalance+request.Amount < 0 {
+				return ResponseMessage{Errno: 1, Errmsg: "account balance can not be negative"}, nil, nil
+			}
+			return ResponseMessage{Errno: 0}, &Account{
+				UsableBalance: state.UsableBalance + request.Amount,
+				FrozenBalance: state.FrozenBalance,
+			}, nil
+		})
+	return store
+}
+
+func Test_typed_store(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	accountId := NewID().String()
+	worker := typedAccounts.StartBackendWorker(backend)
+	_, err := worker.Handle(accountId, "create", "create", nil)
+	should.Nil(err)
+	response, err := worker.Handle(accountId, "xxx-001", "transfer", []byte(`{"Amount":100}`))
+	should.Nil(err)
+	should.Equal(0, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	response, err = worker.Handle(accountId, "xxx-002", "transfer", []byte(`{"Amount":-200}`))
+	should.Nil(err)
+	should.Equal(1, jsoniter.Get(response, "Errno").MustBeValid().ToInt())
+	account, err := typedAccounts.GetFromBackend(backend, accountId)
+	should.Nil(err)
+	should.Equal(int64(3), account.Version)
+	should.Equal(int64(100), account.State.UsableBalance)
+}
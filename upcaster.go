@@ -0,0 +1,49 @@
+package quokka
+
+import "fmt"
+
+// Upcaster transforms the state of one schema version to the next version.
+// Numbers of json rows are json.Number, so that big integers are kept as they are.
+type Upcaster func(state map[string]interface{}) (map[string]interface{}, error)
+
+// StateVersion sets the current schema version of the state, new rows are written with this version.
+// Rows with older version are upcasted when loaded, by the upcasters registered for each step.
+func (store *entityStore) StateVersion(version int) *entityStore {
+	store.stateVersion = version
+	return store
+}
+
+// Upcaster registers the transformation from fromVersion to fromVersion+1
+func (store *entityStore) Upcaster(fromVersion int, upcaster Upcaster) *entityStore {
+	store.upcasters[fromVersion] = upcaster
+	return store
+}
+
+// upcast converts the state of the row to current state version, encoded by the store codec
+func (store *entityStore) upcast(codecName string, stateVersion int, stateJson []byte) ([]byte, error) {
+	if stateVersion == store.stateVersion {
+		return store.transcode(codecName, stateJson)
+	}
+	if stateVersion > store.stateVersion {
+		return nil, fmt.Errorf("state version %v is newer than %v", stateVersion, store.stateVersion)
+	}
+	decoded, err := store.decodeGeneric(codecName, stateJson)
+	if err != nil {
+		return nil, err
+	}
+	state, isMap := decoded.(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("only object state can be upcasted, but got %T", decoded)
+	}
+	for version := stateVersion; version < store.stateVersion; version++ {
+		upcaster := store.upcasters[version]
+		if upcaster == nil {
+			return nil, fmt.Errorf("no upcaster defined for state version %v", version)
+		}
+		state, err = upcaster(state)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upcast state version %v: %v", version, err)
+		}
+	}
+	return store.marshalGeneric(state)
+}
@@ -0,0 +1,95 @@
+package quokka
+
+import (
+	"testing"
+	"encoding/json"
+	"github.com/json-iterator/go/require"
+)
+
+type AccountV2 struct {
+	Balance int64
+	Frozen  int64
+	Owner   string
+}
+
+func Test_multi_step_upcast(t *testing.T) {
+	should := require.New(t)
+	backend := NewMemoryBackend()
+	// written by the old code, which has no state version
+	should.Nil(backend.AppendBatch([]*Event{{
+		EntityId:    "a",
+		Version:     1,
+		CommandId:   "create",
+		CommandName: "create",
+		Response:    []byte(`{}`),
+		State:       []byte(`{"UsableBalance":100,"FrozenBalance":10}`),
+	}}))
+	store := Config{}.Froze().StoreOf("account").
+		StateType(func() interface{} {
+		return &AccountV2{}
+	}).
+		StateVersion(2).
+		Upcaster(0, func(state map[string]interface{}) (map[string]interface{}, error) {
+		state["Balance"] = state["UsableBalance"]
+		state["Frozen"] = state["FrozenBalance"]
+		delete(state, "UsableBalance")
+		delete(state, "FrozenBalance")
+		return state, nil
+	}).
+		Upcaster(1, func(state map[string]interface{}) (map[string]interface{}, error) {
+		state["Owner"] = "unknown"
+		return state, nil
+	}).
+		Command("rename", func() interface{} {
+		return new(string)
+	}, func(request interface{}, state interface{}) (interface{}, interface{}, error) {
+		account := state.(*AccountV2)
+		account.Owner = *request.(*string)
+		return "renamed", account, nil
+	})
+	entity, err := store.GetFromBackend(backend, "a")
+	should.Nil(err)
+	should.Equal(AccountV2{Balance: 100, Frozen: 10, Owner: "unknown"}, *entity.State.(*AccountV2))
+	worker := store.StartBackendWorker(backend)
+	_, err = worker.Handle("a", "xxx-001", "rename", []byte(`"alice"`))
+	should.Nil(err)
+	latest, err := backend.GetLatest("a")
+	should.Nil(err)
+	should.Equal(2, latest.StateVersion)
+	should.Equal(`{"Balance":100,"Frozen":10,"Owner":"alice"}`, string(latest.State))
+}
+
+func Test_upcast_missing_step(t *testing.T) {
+	should := require.New(t)
+	store := Config{}.Froze().StoreOf("account").
+		StateVersion(2).
+		Upcaster(1, func(state map[string]interface{}) (map[string]interface{}, error) {
+		return state, nil
+	})
+	_, err := store.upcast("json", 0, []byte(`{}`))
+	should.NotNil(err)
+	stateJson, err := store.upcast("json", 1, []byte(`{"a":1}`))
+	should.Nil(err)
+	should.Equal(`{"a":1}`, string(stateJson))
+}
+
+func Test_upcast_keeps_big_integer(t *testing.T) {
+	should := require.New(t)
+	store := Config{}.Froze().StoreOf("account").
+		StateVersion(1).
+		Upcaster(0, func(state map[string]interface{}) (map[string]interface{}, error) {
+		state["Owner"] = "unknown"
+		return state, nil
+	})
+	stateJson, err := store.upcast("json", 0, []byte(`{"Balance":9007199254740993}`))
+	should.Nil(err)
+	upcasted, err := decodeJsonNumber(stateJson)
+	should.Nil(err)
+	should.Equal(json.Number("9007199254740993"), upcasted.(map[string]interface{})["Balance"])
+	msgpackStore := Config{StoreCodec: "msgpack"}.Froze().StoreOf("account")
+	transcoded, err := msgpackStore.transcode("json", []byte(`{"Balance":9007199254740993}`))
+	should.Nil(err)
+	var decoded map[string]int64
+	should.Nil(MsgpackCodec.Unmarshal(transcoded, &decoded))
+	should.Equal(int64(9007199254740993), decoded["Balance"])
+}